@@ -0,0 +1,116 @@
+package srsmilter
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// defaultAuditLogMaxSize is the size in megabytes at which we rotate the audit log when AuditLogMaxSize is not set
+const defaultAuditLogMaxSize = 100
+
+// Audit log actions
+const (
+	AuditSender       = "sender"        // we SRS rewrote the envelope sender
+	AuditSplit        = "split"         // we sent a copy with the SRS rewritten envelope sender to the remote recipients
+	AuditRecipientEnv = "recipient_env" // we reversed an SRS envelope recipient
+	AuditRecipientHdr = "recipient_hdr" // we reversed an SRS address in a header field
+	AuditRecipientDsn = "recipient_dsn" // we reversed an SRS address inside a DSN
+)
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	QueueId   string    `json:"qid"`
+	Action    string    `json:"action"`
+	From      string    `json:"from"`
+	NewFrom   string    `json:"newFrom,omitempty"`
+	To        []string  `json:"to,omitempty"`
+	NewTo     []string  `json:"newTo,omitempty"`
+	Header    string    `json:"header,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	SpfResult string    `json:"spfResult,omitempty"`
+	KeyIndex  int       `json:"keyIndex"`
+	DryRun    bool      `json:"dryRun,omitempty"`
+}
+
+// auditWriter is an audit log file that several configurations can share, e.g. the current config and the config
+// that replaces it on a reload. The last configuration that gets closed closes the file.
+type auditWriter struct {
+	*lumberjack.Logger
+	users atomic.Int32
+}
+
+// sameFile returns true when w and o write the same file with the same rotation settings
+func (w *auditWriter) sameFile(o *auditWriter) bool {
+	return w.Filename == o.Filename && w.MaxSize == o.MaxSize && w.MaxBackups == o.MaxBackups &&
+		w.MaxAge == o.MaxAge && w.Compress == o.Compress
+}
+
+// release closes the file when no configuration uses w anymore
+func (w *auditWriter) release() error {
+	if w.users.Add(-1) > 0 {
+		return nil
+	}
+	return w.Logger.Close()
+}
+
+// newAuditLog creates the audit log of c. It returns nil when AuditLog is not set.
+func (c *Configuration) newAuditLog() *auditWriter {
+	if c.AuditLog == "" {
+		return nil
+	}
+	maxSize := c.AuditLogMaxSize
+	if maxSize == 0 {
+		maxSize = defaultAuditLogMaxSize
+	}
+	w := &auditWriter{Logger: &lumberjack.Logger{
+		Filename:   c.AuditLog,
+		MaxSize:    maxSize,
+		MaxBackups: c.AuditLogMaxBackups,
+		MaxAge:     c.AuditLogMaxAge,
+		Compress:   c.AuditLogCompress,
+	}}
+	w.users.Store(1)
+	return w
+}
+
+// ShareAuditLog makes c use the audit log of old when both write the same file with the same rotation settings,
+// so that a reload does not open a second writer for the file. Call it after Setup and before OpenAuditLog.
+// When the settings differ, c keeps its own audit log and the one of old gets closed with old.
+func (c *Configuration) ShareAuditLog(old *Configuration) {
+	if c.auditLog == nil || old == nil || old.auditLog == nil || !c.auditLog.sameFile(old.auditLog) {
+		return
+	}
+	_ = c.auditLog.release()
+	old.auditLog.users.Add(1)
+	c.auditLog = old.auditLog
+}
+
+// OpenAuditLog opens the audit log right away instead of on the first write (e.g. before we drop privileges).
+// It does nothing when there is no audit log.
+func (c *Configuration) OpenAuditLog() error {
+	if c.auditLog == nil {
+		return nil
+	}
+	_, err := c.auditLog.Write(nil)
+	return err
+}
+
+// audit appends r as JSON line to the audit log. It does nothing when there is no audit log.
+func (c *Configuration) audit(r AuditRecord) {
+	if c.auditLog == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	b, err := json.Marshal(r)
+	if err != nil {
+		Log.Error("could not encode audit record", "sub", "milter", "qid", r.QueueId, "err", err)
+		return
+	}
+	if _, err = c.auditLog.Write(append(b, '\n')); err != nil {
+		Log.Error("could not write audit record", "sub", "milter", "qid", r.QueueId, "err", err)
+	}
+}
@@ -0,0 +1,152 @@
+package srsmilter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/d--j/go-milter/mailfilter/addr"
+	"github.com/d--j/go-milter/mailfilter/testtrx"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFilter_audit(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	conf := testConfig(t, &Configuration{
+		SrsKeys:              []string{"new-key", "secret-key"},
+		AlwaysRewriteSenders: []string{"forced@example.org"},
+		AuditLog:             path,
+	})
+	cache := NewCache(conf)
+	trxs := []*testtrx.Trx{
+		(&testtrx.Trx{}).SetQueueId("Q1").
+			SetMailFrom(addr.NewMailFrom("someone@example.net", "", "smtp", "", "")).
+			SetRcptTosList("remote@example.org").
+			SetHeadersRaw([]byte("Subject: test\r\n\r\n")),
+		(&testtrx.Trx{}).SetQueueId("Q2").
+			SetMailFrom(addr.NewMailFrom("forced@example.org", "", "smtp", "", "")).
+			SetRcptTosList("remote@example.org", "other@example.org").
+			SetHeadersRaw([]byte("Subject: test\r\n\r\n")),
+		(&testtrx.Trx{}).SetQueueId("Q3").
+			SetMailFrom(addr.NewMailFrom("", "", "smtp", "", "")).
+			SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com").
+			SetHeadersRaw([]byte("To: SRS0=PNjA=46=example.net=my-srs@srs.example.com\r\n\r\n")),
+		(&testtrx.Trx{}).SetQueueId("Q4").
+			SetMailFrom(addr.NewMailFrom("someone@example.com", "", "smtp", "", "")).
+			SetRcptTosList("local@example.com").
+			SetHeadersRaw([]byte("Subject: test\r\n\r\n")),
+	}
+	for _, trx := range trxs {
+		if _, err := Filter(context.Background(), trx, conf, cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srsFrom, _ := ForwardSrs("someone@example.net", conf)
+	srsForced, _ := ForwardSrs("forced@example.org", conf)
+	want := []AuditRecord{
+		{Time: ConstantDate, QueueId: "Q1", Action: AuditSender, From: "someone@example.net", NewFrom: srsFrom, To: []string{"remote@example.org"}, Reason: ReasonSpf, SpfResult: "fail"},
+		{Time: ConstantDate, QueueId: "Q2", Action: AuditSender, From: "forced@example.org", NewFrom: srsForced, To: []string{"remote@example.org", "other@example.org"}, Reason: ReasonSenderPolicy},
+		{Time: ConstantDate, QueueId: "Q3", Action: AuditRecipientEnv, To: []string{"SRS0=PNjA=46=example.net=my-srs@srs.example.com"}, NewTo: []string{"my-srs@example.net"}, KeyIndex: 1},
+		{Time: ConstantDate, QueueId: "Q3", Action: AuditRecipientHdr, To: []string{"SRS0=PNjA=46=example.net=my-srs@srs.example.com"}, NewTo: []string{"my-srs@example.net"}, Header: "To", KeyIndex: 1},
+	}
+	if got := readAuditLog(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("audit log got = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfiguration_OpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	c := &Configuration{SrsDomain: "srs.example.com", AuditLog: path}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.OpenAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("audit log not created: %v, %v", info, err)
+	}
+	c = &Configuration{SrsDomain: "srs.example.com", AuditLog: filepath.Join(path, "not-a-dir", "audit.jsonl")}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OpenAuditLog(); err == nil {
+		t.Errorf("OpenAuditLog() expected error")
+	}
+}
+
+func TestConfiguration_ShareAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	old := &Configuration{SrsDomain: "srs.example.com", AuditLog: path}
+	if err := old.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	same := &Configuration{SrsDomain: "srs.example.com", AuditLog: path}
+	if err := same.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer same.Close()
+	same.ShareAuditLog(old)
+	if same.auditLog != old.auditLog {
+		t.Errorf("ShareAuditLog() did not share the audit log with the same settings")
+	}
+	rotated := &Configuration{SrsDomain: "srs.example.com", AuditLog: path, AuditLogMaxSize: 1}
+	if err := rotated.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer rotated.Close()
+	rotated.ShareAuditLog(old)
+	if rotated.auditLog == old.auditLog {
+		t.Errorf("ShareAuditLog() shared the audit log with different rotation settings")
+	}
+	_ = old.Close()
+	if got := same.auditLog.users.Load(); got != 1 {
+		t.Errorf("audit log users after closing the old config = %d, want 1", got)
+	}
+	same.audit(AuditRecord{QueueId: "Q1"})
+	if records := readAuditLog(t, path); len(records) != 1 || records[0].QueueId != "Q1" {
+		t.Errorf("audit log = %v, want one record for Q1", records)
+	}
+}
+
+func TestConfiguration_audit_disabled(t *testing.T) {
+	c := &Configuration{SrsDomain: "srs.example.com"}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if c.auditLog != nil {
+		t.Errorf("auditLog = %v, want nil", c.auditLog)
+	}
+	// must not panic
+	c.audit(AuditRecord{QueueId: "Q1"})
+	if err := c.OpenAuditLog(); err != nil {
+		t.Errorf("OpenAuditLog() error = %v", err)
+	}
+}
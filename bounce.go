@@ -0,0 +1,102 @@
+package srsmilter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d--j/go-milter/mailfilter"
+	"github.com/d--j/go-milter/mailfilter/addr"
+)
+
+// defaultBounceSenders are the senders besides the null sender that may send mail to our SRS addresses when BounceSenders is not set
+var defaultBounceSenders = []string{"postmaster", "mailer-daemon"}
+
+// bounceStatsWindow is the time window we count bounces per original domain in
+const bounceStatsWindow = time.Hour
+
+// bounceSenders matches the envelope senders of bounces
+type bounceSenders struct {
+	locals    map[string]bool
+	addresses *addressMatcher
+}
+
+// newBounceSenders parses the BounceSenders entries. Entries without @ are local parts that match in every domain,
+// all other entries get matched with an addressMatcher.
+func newBounceSenders(in []string) (*bounceSenders, error) {
+	if len(in) == 0 {
+		in = defaultBounceSenders
+	}
+	b := &bounceSenders{locals: make(map[string]bool)}
+	var entries []string
+	for _, entry := range in {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.IndexByte(entry, '@') < 0 && !isDomainRegexp(entry) {
+			b.locals[strings.ToLower(entry)] = true
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	var err error
+	if b.addresses, err = newAddressMatcher(entries); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IsBounceSender returns true when from is the null sender or matches any of the BounceSenders
+func (c *Configuration) IsBounceSender(from *addr.MailFrom) bool {
+	if from.Addr == "" {
+		return true
+	}
+	if c.bounceSenders == nil {
+		return false
+	}
+	return c.bounceSenders.locals[strings.ToLower(from.Local())] || c.bounceSenders.addresses.Match(from.Local(), from.AsciiDomain())
+}
+
+// ValidateRcptTo rejects the recipient of in when BounceMode is on, the recipient is one of our SRS addresses and the
+// envelope sender is not a bounce sender. The milter uses it to reject these recipients at the RCPT TO stage,
+// so that the sending MTA knows about every recipient we do not accept.
+func ValidateRcptTo(_ context.Context, in *mailfilter.RcptToValidationInput, config *Configuration) (mailfilter.Decision, error) {
+	if !config.BounceMode || in.RcptTo.AsciiDomain() != config.SrsDomain.String() || !looksLikeSrs(in.RcptTo.Local()) {
+		return mailfilter.Accept, nil
+	}
+	if config.IsBounceSender(in.MailFrom) {
+		return mailfilter.Accept, nil
+	}
+	if config.isDryRunEnvelope(in.MailFrom, []*addr.RcptTo{in.RcptTo}) {
+		// Filter logs the would-be rejection
+		return mailfilter.Accept, nil
+	}
+	Log.Info("rejecting non-bounce to SRS address", "sub", "milter", "ofrom", in.MailFrom.Addr, "to", in.RcptTo.Addr)
+	return mailfilter.CustomErrorResponse(550, "5.7.1 SRS addresses only accept bounces"), nil
+}
+
+// bounceStats counts bounces per original recipient domain
+type bounceStats struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// CountBounce records a bounce to an SRS address of the original domain asciiDomain and returns the number of bounces
+// for asciiDomain in the current time window. When a time window ends, we log the bounce counts of all domains.
+func (c *Cache) CountBounce(asciiDomain string) int {
+	c.bounces.mu.Lock()
+	defer c.bounces.mu.Unlock()
+	now := time.Now()
+	if c.bounces.counts == nil || now.Sub(c.bounces.start) >= bounceStatsWindow {
+		for domain, count := range c.bounces.counts {
+			Log.Info("bounce rate", "sub", "milter", "domain", domain, "count", count, "window", bounceStatsWindow)
+		}
+		c.bounces.start = now
+		c.bounces.counts = make(map[string]int)
+	}
+	c.bounces.counts[asciiDomain]++
+	return c.bounces.counts[asciiDomain]
+}
@@ -0,0 +1,100 @@
+package srsmilter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/d--j/go-milter/mailfilter"
+	"github.com/d--j/go-milter/mailfilter/addr"
+)
+
+func TestConfiguration_IsBounceSender(t *testing.T) {
+	tests := []struct {
+		name    string
+		senders []string
+		from    string
+		want    bool
+	}{
+		{"null", nil, "", true},
+		{"default-postmaster", nil, "Postmaster@example.org", true},
+		{"default-mailer-daemon", nil, "MAILER-DAEMON@mx.example.org", true},
+		{"default-other", nil, "someone@example.org", false},
+		{"custom-local", []string{"bounces"}, "bounces@example.org", true},
+		{"custom-replaces-default", []string{"bounces"}, "postmaster@example.org", false},
+		{"custom-address", []string{"noreply@example.org"}, "noreply@example.org", true},
+		{"custom-address-other-domain", []string{"noreply@example.org"}, "noreply@example.net", false},
+		{"custom-domain", []string{"*@*.bounces.example"}, "abc@mx.bounces.example", true},
+		{"custom-regexp", []string{"/^bounces\\./"}, "abc@bounces.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Configuration{SrsDomain: "srs.example.com", BounceSenders: tt.senders}
+			if err := c.Setup(); err != nil {
+				t.Fatal(err)
+			}
+			from := addr.NewMailFrom(tt.from, "", "smtp", "", "")
+			if got := c.IsBounceSender(&from); got != tt.want {
+				t.Errorf("IsBounceSender() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newBounceSenders(t *testing.T) {
+	if _, err := newBounceSenders([]string{"/(broken/"}); err == nil {
+		t.Errorf("newBounceSenders() expected error for broken regexp")
+	}
+}
+
+func TestValidateRcptTo(t *testing.T) {
+	reject := mailfilter.CustomErrorResponse(550, "5.7.1 SRS addresses only accept bounces")
+	tests := []struct {
+		name       string
+		bounceMode bool
+		dryRun     []string
+		from       string
+		to         string
+		want       mailfilter.Decision
+	}{
+		{"bounce-mode-off", false, nil, "someone@example.org", "SRS0=PNjA=46=example.net=my-srs@srs.example.com", mailfilter.Accept},
+		{"null-sender", true, nil, "", "SRS0=PNjA=46=example.net=my-srs@srs.example.com", mailfilter.Accept},
+		{"postmaster", true, nil, "postmaster@example.org", "SRS0=PNjA=46=example.net=my-srs@srs.example.com", mailfilter.Accept},
+		{"not-srs", true, nil, "someone@example.org", "postmaster@srs.example.com", mailfilter.Accept},
+		{"other-domain", true, nil, "someone@example.org", "local@example.com", mailfilter.Accept},
+		{"reject", true, nil, "someone@example.org", "SRS0=PNjA=46=example.net=my-srs@srs.example.com", reject},
+		{"dry-run", true, []string{"example.org"}, "someone@example.org", "SRS0=PNjA=46=example.net=my-srs@srs.example.com", mailfilter.Accept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, &Configuration{BounceMode: tt.bounceMode, DryRunDomains: toDomainSlice(tt.dryRun)})
+			from := addr.NewMailFrom(tt.from, "", "smtp", "", "")
+			to := addr.NewRcptTo(tt.to, "", "smtp")
+			got, err := ValidateRcptTo(context.Background(), &mailfilter.RcptToValidationInput{MailFrom: &from, RcptTo: to}, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateRcptTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCache_CountBounce(t *testing.T) {
+	c := NewCache(&Configuration{})
+	if got := c.CountBounce("example.com"); got != 1 {
+		t.Errorf("CountBounce() = %v, want 1", got)
+	}
+	if got := c.CountBounce("example.com"); got != 2 {
+		t.Errorf("CountBounce() = %v, want 2", got)
+	}
+	if got := c.CountBounce("example.net"); got != 1 {
+		t.Errorf("CountBounce() = %v, want 1", got)
+	}
+	c.bounces.start = c.bounces.start.Add(-bounceStatsWindow - time.Second)
+	if got := c.CountBounce("example.com"); got != 1 {
+		t.Errorf("CountBounce() after window = %v, want 1", got)
+	}
+}
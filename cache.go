@@ -1,23 +1,33 @@
 package srsmilter
 
 import (
+	"context"
 	"time"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/jellydator/ttlcache/v3"
 )
 
-func emptyTtlCache() *ttlcache.Cache[string, bool] {
-	return ttlcache.New[string, bool](
-		ttlcache.WithCapacity[string, bool](1*1024*1024*1024),
-		ttlcache.WithTTL[string, bool](30*time.Minute),
-		ttlcache.WithDisableTouchOnHit[string, bool](),
+func emptyTtlCache() *ttlcache.Cache[string, spf.Result] {
+	cache := ttlcache.New[string, spf.Result](
+		ttlcache.WithCapacity[string, spf.Result](1*1024*1024*1024),
+		ttlcache.WithTTL[string, spf.Result](30*time.Minute),
+		ttlcache.WithDisableTouchOnHit[string, spf.Result](),
 	)
+	cache.OnEviction(func(_ context.Context, _ ttlcache.EvictionReason, _ *ttlcache.Item[string, spf.Result]) {
+		metricSpfCacheEvictions.Inc()
+	})
+	return cache
 }
 
+// cacheCleanupInterval is the interval in which a started Cache removes expired SPF results
+const cacheCleanupInterval = time.Minute
+
 type Cache struct {
-	conf  *Configuration
-	cache *ttlcache.Cache[string, bool]
+	conf    *Configuration
+	cache   *ttlcache.Cache[string, spf.Result]
+	bounces bounceStats // starts over with every new Cache, i.e. on every config reload
+	done    chan struct{}
 }
 
 func NewCache(conf *Configuration) *Cache {
@@ -27,27 +37,89 @@ func NewCache(conf *Configuration) *Cache {
 	}
 }
 
+// Start removes expired SPF results in the background until Stop gets called.
+// Without it expired results stay in memory until they get looked up again.
+func (c *Cache) Start() {
+	c.start(cacheCleanupInterval)
+}
+
+func (c *Cache) start(interval time.Duration) {
+	c.done = make(chan struct{})
+	go func(done <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.cache.DeleteExpired()
+			}
+		}
+	}(c.done)
+}
+
+// Stop stops removing expired SPF results
+func (c *Cache) Stop() {
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+}
+
 func (c *Cache) IsLocalNotAllowedToSend(addr, asciiDomain string) bool {
+	return isNotAllowedToSend(c.SpfResult(addr, asciiDomain))
+}
+
+// isNotAllowedToSend returns true when the SPF result means that we need to SRS rewrite
+func isNotAllowedToSend(result spf.Result) bool {
+	return result == spf.Fail || result == spf.SoftFail
+}
+
+// SpfResult returns the (cached) result of the SPF checks of our LocalIps for asciiDomain.
+// When any of our IPs is not allowed to send, it returns the result for this IP.
+func (c *Cache) SpfResult(addr, asciiDomain string) spf.Result {
 	if res := c.cache.Get(asciiDomain); res != nil {
+		metricSpfCache.WithLabelValues("hit").Inc()
 		return res.Value()
 	}
+	metricSpfCache.WithLabelValues("miss").Inc()
 	// Check if we are not authorized to send for `addr.Addr`
+	var result spf.Result
 	for _, ip := range c.conf.LocalIps {
-		result, _ := spf.CheckHostWithSender(ip, asciiDomain, addr)
+		start := time.Now()
+		result, _ = spf.CheckHostWithSender(ip, asciiDomain, addr)
+		metricSpfLookupDuration.Observe(time.Since(start).Seconds())
+		Log.Debug("spf check", "sub", "spf", "ip", ip, "domain", asciiDomain, "result", result)
 		// We rewrite when any of our IPs is not allowed to send
-		if result == spf.Fail || result == spf.SoftFail {
-			c.Set(asciiDomain, true)
-			return true
+		if isNotAllowedToSend(result) {
+			break
 		}
 		// if SPF record is empty or broken we quit early since checking with other IPs will not change result
 		if result == spf.None || result == spf.PermError {
 			break
 		}
 	}
-	c.Set(asciiDomain, false)
-	return false
+	c.Set(asciiDomain, result)
+	return result
+}
+
+func (c *Cache) Set(asciiDomain string, result spf.Result) {
+	c.cache.Set(asciiDomain, result, ttlcache.DefaultTTL)
 }
 
-func (c *Cache) Set(asciiDomain string, isLocalNotAllowedToSend bool) {
-	c.cache.Set(asciiDomain, isLocalNotAllowedToSend, ttlcache.DefaultTTL)
+// LogStats logs the size and hit rate of the SPF cache and the bounce counts of the current time window.
+// The cached SPF results get logged with debug level.
+func (c *Cache) LogStats() {
+	m := c.cache.Metrics()
+	Log.Info("cache stats", "sub", "spf", "entries", c.cache.Len(), "hits", m.Hits, "misses", m.Misses, "evictions", m.Evictions)
+	c.cache.Range(func(item *ttlcache.Item[string, spf.Result]) bool {
+		Log.Debug("cache entry", "sub", "spf", "domain", item.Key(), "result", item.Value(), "rewrite", isNotAllowedToSend(item.Value()), "expires", item.ExpiresAt())
+		return true
+	})
+	c.bounces.mu.Lock()
+	defer c.bounces.mu.Unlock()
+	for domain, count := range c.bounces.counts {
+		Log.Info("bounce stats", "sub", "milter", "domain", domain, "count", count, "since", c.bounces.start)
+	}
 }
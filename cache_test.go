@@ -2,12 +2,15 @@ package srsmilter
 
 import (
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"blitiri.com.ar/go/spf"
 	"github.com/agiledragon/gomonkey/v2"
+	"github.com/inconshreveable/log15"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var ConstantDate = time.Date(2023, time.January, 1, 12, 0, 0, 0, time.UTC)
@@ -67,3 +70,48 @@ func TestNewCache(t *testing.T) {
 		t.Errorf("cache not set")
 	}
 }
+
+func TestCache_LogStats(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	var records []*log15.Record
+	handler := Log.GetHandler()
+	t.Cleanup(func() { Log.SetHandler(handler) })
+	Log.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	c := NewCache(&Configuration{LocalIps: []net.IP{net.ParseIP("8.8.8.8")}})
+	c.IsLocalNotAllowedToSend("someone@example.net", "example.net")
+	c.IsLocalNotAllowedToSend("someone@example.net", "example.net")
+	c.CountBounce("example.org")
+	records = nil
+	c.LogStats()
+	var msgs []string
+	for _, r := range records {
+		msgs = append(msgs, r.Msg)
+	}
+	if want := []string{"cache stats", "cache entry", "bounce stats"}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("LogStats() logged %v, want %v", msgs, want)
+	}
+	if want := []interface{}{"sub", "spf", "entries", 1, "hits", uint64(1), "misses", uint64(1), "evictions", uint64(0)}; !reflect.DeepEqual(records[0].Ctx, want) {
+		t.Errorf("LogStats() logged %v, want %v", records[0].Ctx, want)
+	}
+}
+
+func TestCache_start(t *testing.T) {
+	c := NewCache(&Configuration{})
+	evictions := testutil.ToFloat64(metricSpfCacheEvictions)
+	c.cache.Set("example.com", spf.Pass, time.Millisecond)
+	c.start(time.Millisecond)
+	defer c.Stop()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(metricSpfCacheEvictions)-evictions < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entry did not get evicted, entries = %d", c.cache.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.cache.Len() != 0 {
+		t.Errorf("entries = %d, want 0", c.cache.Len())
+	}
+}
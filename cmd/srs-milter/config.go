@@ -2,15 +2,19 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"path/filepath"
 	"reflect"
 	"strings"
 
 	"github.com/d--j/srs-milter"
+	"github.com/fsnotify/fsnotify"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/inconshreveable/log15"
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
-	"golang.org/x/net/idna"
 )
 
 func determineExternalIPs() ([]net.IP, error) {
@@ -63,32 +67,48 @@ func ipsToString(ips []net.IP) string {
 
 func loadViperConfig() (*srsmilter.Configuration, error) {
 	var conf srsmilter.Configuration
-	err := viper.Unmarshal(&conf, viper.DecodeHook(mapstructure.StringToIPHookFunc()), viper.DecodeHook(func(
-		f reflect.Type,
-		t reflect.Type,
-		data interface{}) (interface{}, error) {
-		if f.Kind() != reflect.String {
-			return data, nil
-		}
-		if t != reflect.TypeOf(srsmilter.Domain("")) {
-			return data, nil
-		}
+	err := viper.Unmarshal(&conf, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		func(
+			f reflect.Type,
+			t reflect.Type,
+			data interface{}) (interface{}, error) {
+			if f.Kind() != reflect.String {
+				return data, nil
+			}
+			if t != reflect.TypeOf(srsmilter.Domain("")) {
+				return data, nil
+			}
 
-		asciiDomain, err := idna.Lookup.ToASCII(data.(string))
-		return srsmilter.Domain(asciiDomain), err
-	}), viper.DecodeHook(func(
-		f reflect.Type,
-		t reflect.Type,
-		data interface{}) (interface{}, error) {
-		if f.Kind() != reflect.String {
-			return data, nil
-		}
-		if t != reflect.TypeOf(net.IP{}) {
-			return data, nil
-		}
+			return srsmilter.ParseDomain(data.(string))
+		},
+		func(
+			f reflect.Type,
+			t reflect.Type,
+			data interface{}) (interface{}, error) {
+			if f.Kind() != reflect.String {
+				return data, nil
+			}
+			if t != reflect.TypeOf(net.IP{}) {
+				return data, nil
+			}
 
-		return net.ParseIP(data.(string)), nil
-	}))
+			return net.ParseIP(data.(string)), nil
+		},
+		func(
+			f reflect.Type,
+			t reflect.Type,
+			data interface{}) (interface{}, error) {
+			if f.Kind() != reflect.String {
+				return data, nil
+			}
+			if t != reflect.TypeOf(srsmilter.LogLevel(0)) {
+				return data, nil
+			}
+
+			return srsmilter.ParseLogLevel(data.(string))
+		},
+	)))
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +118,9 @@ func loadViperConfig() (*srsmilter.Configuration, error) {
 	if len(conf.SrsKeys) == 0 {
 		return nil, errors.New("no srsKeys specified in config file")
 	}
+	if err = validateLogConfig(&conf); err != nil {
+		return nil, err
+	}
 	if len(conf.LocalIps) == 0 {
 		conf.LocalIps, err = determineExternalIPs()
 		if err != nil {
@@ -106,3 +129,79 @@ func loadViperConfig() (*srsmilter.Configuration, error) {
 	}
 	return &conf, nil
 }
+
+// reloadedConfig is the result of a config reload that ran in the background
+type reloadedConfig struct {
+	config    *srsmilter.Configuration
+	logger    log15.Handler
+	logCloser io.Closer
+	err       error
+}
+
+// prepareConfig reads the config file again and sets up a new config and its log handler. It only shares the
+// audit log of the current config, so it can run outside the main loop. When anything fails, it closes what it
+// already opened.
+func prepareConfig(current *srsmilter.Configuration, systemd bool) reloadedConfig {
+	if err := viper.ReadInConfig(); err != nil {
+		return reloadedConfig{err: err}
+	}
+	conf, err := loadViperConfig()
+	if err != nil {
+		return reloadedConfig{err: err}
+	}
+	if err = conf.Setup(); err == nil {
+		conf.ShareAuditLog(current)
+		err = conf.OpenAuditLog()
+	}
+	if err != nil {
+		_ = conf.Close()
+		return reloadedConfig{err: err}
+	}
+	handler, closer, err := newConfigLogHandler(conf, systemd)
+	if err != nil {
+		_ = conf.Close()
+		return reloadedConfig{err: fmt.Errorf("could not configure logging: %w", err)}
+	}
+	return reloadedConfig{config: conf, logger: handler, logCloser: closer}
+}
+
+// watchConfigFile sends to changed when the config file at path gets written or replaced (e.g. a symlink swap).
+// In contrast to viper.WatchConfig it does not read the file itself, so that the caller can do all reloads in one goroutine.
+func watchConfigFile(logger log15.Logger, path string, changed chan<- struct{}) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	configFile := filepath.Clean(path)
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	if err = watcher.Add(filepath.Dir(configFile)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				written := filepath.Clean(event.Name) == configFile && event.Has(fsnotify.Write|fsnotify.Create)
+				if written || (currentConfigFile != "" && currentConfigFile != realConfigFile) {
+					realConfigFile = currentConfigFile
+					select {
+					case changed <- struct{}{}:
+					default:
+						// there already is a pending reload
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("error watching config file", "err", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
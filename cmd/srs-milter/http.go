@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/d--j/srs-milter"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func init() {
+	srsmilter.Metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// readyTimeout limits the time all readiness checks together may take
+const readyTimeout = 5 * time.Second
+
+// healthCheck is one check of the /readyz endpoint
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResult struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// runningCheck returns a check that fails once the server that closes done stopped
+func runningCheck(done <-chan struct{}) func(ctx context.Context) error {
+	return func(_ context.Context) error {
+		select {
+		case <-done:
+			return errors.New("stopped")
+		default:
+			return nil
+		}
+	}
+}
+
+// listenerCheck returns a check that makes sure that the listener ln accepts connections
+func listenerCheck(ln net.Addr) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := (&net.Dialer{}).DialContext(ctx, ln.Network(), ln.String())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// runChecks runs all checks in parallel
+func runChecks(ctx context.Context, checks []healthCheck) healthResult {
+	res := healthResult{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			r := checkResult{Status: "ok"}
+			if err := c.check(ctx); err != nil {
+				r = checkResult{Status: "fail", Error: err.Error()}
+			}
+			mu.Lock()
+			res.Checks[c.name] = r
+			if r.Status != "ok" {
+				res.Status = "fail"
+			}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return res
+}
+
+func writeHealthResult(w http.ResponseWriter, res healthResult) {
+	w.Header().Set("Content-Type", "application/json")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// newHttpServer creates the HTTP server that serves our Prometheus metrics on /metrics
+// and the health checks on /healthz (liveness) and /readyz (readiness).
+func newHttpServer(checks []healthCheck) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(srsmilter.Metrics, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeHealthResult(w, healthResult{Status: "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		writeHealthResult(w, runChecks(ctx, checks))
+	})
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// serveHttp serves the HTTP server on ln in the background
+func serveHttp(ln net.Listener, checks []healthCheck) *http.Server {
+	server := newHttpServer(checks)
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	return server
+}
@@ -1,6 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/d--j/srs-milter"
 	"github.com/go-logfmt/logfmt"
 	"github.com/inconshreveable/log15"
 )
@@ -22,3 +32,232 @@ func LogfmtFormatWithoutTime() log15.Format {
 		return b
 	})
 }
+
+func JsonFormatWithTime() log15.Format {
+	return jsonFormat(true)
+}
+
+func JsonFormatWithoutTime() log15.Format {
+	return jsonFormat(false)
+}
+
+// jsonFormat formats records as one JSON object per line
+func jsonFormat(withTime bool) log15.Format {
+	return log15.FormatFunc(func(r *log15.Record) []byte {
+		props := make(map[string]interface{}, 3+len(r.Ctx)/2)
+		if withTime {
+			props[r.KeyNames.Time] = r.Time
+		}
+		props[r.KeyNames.Lvl] = r.Lvl.String()
+		props[r.KeyNames.Msg] = r.Msg
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			props[fmt.Sprint(r.Ctx[i])] = jsonValue(r.Ctx[i+1])
+		}
+		b, err := json.Marshal(props)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{r.KeyNames.Lvl: r.Lvl.String(), r.KeyNames.Msg: r.Msg, "logErr": err.Error()})
+		}
+		return append(b, '\n')
+	})
+}
+
+// jsonValue converts v into something that has a sensible JSON representation
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Marshaler:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// logFormat returns the log15.Format for the logFormat config value
+func logFormat(name string, withTime bool) log15.Format {
+	if name == "json" {
+		if withTime {
+			return JsonFormatWithTime()
+		}
+		return JsonFormatWithoutTime()
+	}
+	if withTime {
+		return LogfmtFormatWithTime()
+	}
+	return LogfmtFormatWithoutTime()
+}
+
+// validateLogConfig checks the logFormat, logOutput and logFile config values
+func validateLogConfig(conf *srsmilter.Configuration) error {
+	switch conf.LogFormat {
+	case "", "logfmt", "json":
+	default:
+		return fmt.Errorf("invalid logFormat %q (use logfmt or json)", conf.LogFormat)
+	}
+	switch conf.LogOutput {
+	case "", "stdout", "syslog", "journald":
+	case "file":
+		if conf.LogFile == "" {
+			return fmt.Errorf("logOutput file needs logFile")
+		}
+	default:
+		return fmt.Errorf("invalid logOutput %q (use stdout, file, syslog or journald)", conf.LogOutput)
+	}
+	return nil
+}
+
+// newLogHandler creates the handler for the logFormat, logOutput and logFile config values.
+// The returned closer is non-nil when the handler holds resources that need to be released.
+// In systemd mode we do not log the date/time to stdout – journald will add those anyway.
+func newLogHandler(conf *srsmilter.Configuration, systemd bool) (log15.Handler, io.Closer, error) {
+	switch conf.LogOutput {
+	case "file":
+		f, err := openLogFile(conf.LogFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return log15.StreamHandler(f, logFormat(conf.LogFormat, true)), f, nil
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_MAIL, "srs-milter")
+		if err != nil {
+			return nil, nil, err
+		}
+		return syslogHandler(w, logFormat(conf.LogFormat, false)), w, nil
+	case "journald":
+		if !journal.Enabled() {
+			return nil, nil, fmt.Errorf("journald is not available")
+		}
+		return journaldHandler(logFormat(conf.LogFormat, false)), nil, nil
+	default:
+		return log15.StreamHandler(os.Stdout, logFormat(conf.LogFormat, !systemd)), nil, nil
+	}
+}
+
+// newConfigLogHandler is newLogHandler with the log levels of conf applied
+func newConfigLogHandler(conf *srsmilter.Configuration, systemd bool) (log15.Handler, io.Closer, error) {
+	handler, closer, err := newLogHandler(conf, systemd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srsmilter.LogFilterHandler(conf, handler), closer, nil
+}
+
+// syslogHandler writes records to the local syslog daemon with the syslog severity of their level
+func syslogHandler(w *syslog.Writer, fmtr log15.Format) log15.Handler {
+	return log15.FuncHandler(func(r *log15.Record) error {
+		msg := strings.TrimSpace(string(fmtr.Format(r)))
+		switch r.Lvl {
+		case log15.LvlCrit:
+			return w.Crit(msg)
+		case log15.LvlError:
+			return w.Err(msg)
+		case log15.LvlWarn:
+			return w.Warning(msg)
+		case log15.LvlInfo:
+			return w.Info(msg)
+		default:
+			return w.Debug(msg)
+		}
+	})
+}
+
+// journaldHandler sends records via the native journald protocol. All context values become journal fields
+// (e.g. qid becomes QID), so you can filter with e.g. journalctl QID=4F8A5C0D2B.
+func journaldHandler(fmtr log15.Format) log15.Handler {
+	return log15.FuncHandler(func(r *log15.Record) error {
+		vars := map[string]string{"SYSLOG_IDENTIFIER": "srs-milter"}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if name := journalFieldName(fmt.Sprint(r.Ctx[i])); name != "" {
+				vars[name] = fmt.Sprint(jsonValue(r.Ctx[i+1]))
+			}
+		}
+		return journal.Send(strings.TrimSpace(string(fmtr.Format(r))), journalPriority(r.Lvl), vars)
+	})
+}
+
+func journalPriority(lvl log15.Lvl) journal.Priority {
+	switch lvl {
+	case log15.LvlCrit:
+		return journal.PriCrit
+	case log15.LvlError:
+		return journal.PriErr
+	case log15.LvlWarn:
+		return journal.PriWarning
+	case log15.LvlInfo:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
+
+// journalFieldName converts key into a valid journal field name (upper case letters, digits and underscores)
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	switch name {
+	case "", "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER":
+		return ""
+	}
+	return name
+}
+
+// logFile is an append-only log file that can be reopened after logrotate moved it away
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	return l.f.Write(p)
+}
+
+// Reopen closes the log file and opens it again (creating a new file when it was moved away)
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		_ = l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
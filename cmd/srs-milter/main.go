@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
+	"io/fs"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/d--j/go-milter/mailfilter"
-	"github.com/d--j/go-socketmap"
 	"github.com/d--j/srs-milter"
-	"github.com/fsnotify/fsnotify"
 	"github.com/inconshreveable/log15"
 	"github.com/spf13/viper"
 )
@@ -18,8 +24,21 @@ import (
 var RuntimeConfig *srsmilter.Configuration
 var RuntimeCache *srsmilter.Cache
 var RuntimeConfigMutex sync.RWMutex
+
+// RuntimeUsers counts the milter sessions, socketmap requests and health checks that use RuntimeConfig and RuntimeCache
+var RuntimeUsers = &sync.WaitGroup{}
 var LogHandler log15.Handler
 
+// acquireRuntime returns the current config and cache. Call release when you do not use them anymore,
+// a replaced config only gets closed after all its users released it.
+func acquireRuntime() (config *srsmilter.Configuration, cache *srsmilter.Cache, release func()) {
+	RuntimeConfigMutex.RLock()
+	defer RuntimeConfigMutex.RUnlock()
+	users := RuntimeUsers
+	users.Add(1)
+	return RuntimeConfig, RuntimeCache, users.Done
+}
+
 var (
 	version = "dev"
 	commit  = "none"
@@ -30,7 +49,9 @@ var (
 func main() {
 	// parse commandline arguments
 	var systemd bool
-	var milterProtocol, milterAddress, socketmapProtocol, socketmapAddress, forward, reverse string
+	var drainTimeout time.Duration
+	var milterProtocol, milterAddress, socketmapProtocol, socketmapAddress, metricsAddress, forward, reverse string
+	var socketMode, socketOwner, socketGroup, runUser, runGroup string
 	flag.StringVar(&milterProtocol,
 		"milterProto",
 		"tcp",
@@ -47,6 +68,30 @@ func main() {
 		"socketmapAddr",
 		"127.0.0.1:10383",
 		"Bind socketmap server to `address/port` or unix domain socket path")
+	flag.StringVar(&socketMode,
+		"socketMode",
+		"",
+		"Octal file `mode` of unix domain sockets (e.g. 0660). Defaults to the umask.")
+	flag.StringVar(&socketOwner,
+		"socketOwner",
+		"",
+		"`user` name or id that owns unix domain sockets")
+	flag.StringVar(&socketGroup,
+		"socketGroup",
+		"",
+		"`group` name or id of unix domain sockets")
+	flag.StringVar(&runUser,
+		"user",
+		"",
+		"Drop privileges to `user` (name or id) after binding the sockets and opening the config")
+	flag.StringVar(&runGroup,
+		"group",
+		"",
+		"Drop privileges to `group` (name or id) after binding the sockets and opening the config. Defaults to the group of -user.")
+	flag.StringVar(&metricsAddress,
+		"metricsAddr",
+		"",
+		"Serve Prometheus metrics and health checks via HTTP on `address/port` (e.g. 127.0.0.1:10384). Disabled when empty.")
 	flag.StringVar(&forward,
 		"forward",
 		"",
@@ -55,6 +100,10 @@ func main() {
 		"reverse",
 		"",
 		"`email` to do reverse SRS lookup for. If specified the daemon will not be started.")
+	flag.DurationVar(&drainTimeout,
+		"drainTimeout",
+		30*time.Second,
+		"Maximum `duration` to wait for running milter sessions and socketmap requests on shutdown")
 	flag.BoolVar(&systemd, "systemd", false, "enable systemd mode (log without date/time)")
 	flag.Parse()
 
@@ -78,8 +127,17 @@ func main() {
 		logger.Crit("invalid socketmap protocol name", "protocol", socketmapProtocol)
 		os.Exit(1)
 	}
+	perms, err := parseSocketPerms(socketMode, socketOwner, socketGroup)
+	if err != nil {
+		logger.Crit("invalid socket permissions", "err", err)
+		os.Exit(1)
+	}
+	privs, err := lookupPrivileges(runUser, runGroup)
+	if err != nil {
+		logger.Crit("invalid user or group", "err", err)
+		os.Exit(1)
+	}
 
-	var err error
 	viper.SetConfigName("srs-milter")
 	viper.AddConfigPath("/etc/srs-milter")
 	viper.AddConfigPath(".")
@@ -98,32 +156,28 @@ func main() {
 		os.Exit(1)
 	}
 	RuntimeCache = srsmilter.NewCache(RuntimeConfig)
-	configureLogging := func() {
-		if systemd {
-			LogHandler = log15.StreamHandler(os.Stdout, LogfmtFormatWithoutTime())
-		} else {
-			LogHandler = log15.StreamHandler(os.Stdout, LogfmtFormatWithTime())
-		}
-		switch RuntimeConfig.LogLevel {
-		case 0:
-			LogHandler = log15.LvlFilterHandler(log15.LvlCrit, LogHandler)
-		case 1:
-			LogHandler = log15.LvlFilterHandler(log15.LvlError, LogHandler)
-		case 2:
-			LogHandler = log15.LvlFilterHandler(log15.LvlWarn, LogHandler)
-		case 3:
-			LogHandler = log15.LvlFilterHandler(log15.LvlInfo, LogHandler)
-		default:
-			LogHandler = log15.LvlFilterHandler(log15.LvlDebug, LogHandler)
-		}
+	// logCloser releases the resources of the current log handler (e.g. the log file)
+	var logCloser io.Closer
+	// useLogHandler makes handler (created for RuntimeConfig) the log handler and releases the previous one
+	useLogHandler := func(handler log15.Handler, closer io.Closer) {
+		LogHandler = handler
 		logger.SetHandler(LogHandler)
 		srsmilter.Log.SetHandler(LogHandler)
+		if logCloser != nil {
+			_ = logCloser.Close()
+		}
+		logCloser = closer
 		logger.Info("config loaded", log15.Ctx{"srsDomain": RuntimeConfig.SrsDomain, "localIps": ipsToString(RuntimeConfig.LocalIps), "numKeys": len(RuntimeConfig.SrsKeys), "numLocalDomains": len(RuntimeConfig.LocalDomains)})
-		if len(RuntimeConfig.LocalDomains) == 0 {
+		if len(RuntimeConfig.LocalDomains) == 0 && RuntimeConfig.LocalDomainsQuery == "" && RuntimeConfig.LocalDomainsFile == "" {
 			logger.Warn("local domain list is empty: only relying on SPF lookups")
 		}
 	}
-	configureLogging()
+	handler, closer, err := newConfigLogHandler(RuntimeConfig, systemd)
+	if err != nil {
+		logger.Crit("error configuring logging", log15.Ctx{"err": err})
+		os.Exit(1)
+	}
+	useLogHandler(handler, closer)
 
 	if forward != "" {
 		srsAddress, err := srsmilter.ForwardSrs(forward, RuntimeConfig)
@@ -136,54 +190,337 @@ func main() {
 	if forward != "" || reverse != "" {
 		return
 	}
+	// open the audit log now, we might not be allowed to create it after dropping privileges
+	if err = RuntimeConfig.OpenAuditLog(); err != nil {
+		logger.Crit("error opening audit log", "err", err)
+		os.Exit(1)
+	}
+	RuntimeCache.Start()
 
-	viper.OnConfigChange(func(_ fsnotify.Event) {
-		newConfig, err := loadViperConfig()
-		if err != nil {
-			logger.Error("could not load new config on change", "err", err)
-		} else {
-			err = newConfig.Setup()
-			if err != nil {
-				logger.Error("could not load new config on change", "err", err)
+	// we only need the message body for some features – only request it when we actually need it
+	decisionAt := mailfilter.DecisionAtEndOfHeaders
+	if RuntimeConfig.NeedsBody() {
+		decisionAt = mailfilter.DecisionAtEndOfMessage
+	}
+
+	// swapConfig makes the reloaded config the current config. Running milter sessions and socketmap requests might
+	// still use the old config, so we close it only after they released it.
+	swapConfig := func(r reloadedConfig) {
+		newConfig := r.config
+		if newConfig.NeedsBody() && decisionAt != mailfilter.DecisionAtEndOfMessage {
+			logger.Warn("new config needs the message body, restart srs-milter to activate this")
+		}
+		RuntimeConfigMutex.Lock()
+		oldConfig, oldCache, oldUsers := RuntimeConfig, RuntimeCache, RuntimeUsers
+		RuntimeConfig = newConfig
+		RuntimeCache = srsmilter.NewCache(RuntimeConfig)
+		RuntimeCache.Start()
+		RuntimeUsers = &sync.WaitGroup{}
+		useLogHandler(r.logger, r.logCloser)
+		RuntimeConfigMutex.Unlock()
+		go func() {
+			oldCache.Stop()
+			oldUsers.Wait()
+			if err := oldConfig.Close(); err != nil {
+				logger.Warn("could not close old config", "err", err)
 			}
-			RuntimeConfigMutex.Lock()
-			RuntimeConfig = newConfig
-			RuntimeCache = srsmilter.NewCache(RuntimeConfig)
-			configureLogging()
-			RuntimeConfigMutex.Unlock()
+		}()
+	}
+	// The config watcher and SIGHUP both trigger reloads. We set up the new config in the background, so that
+	// e.g. a slow database does not block the main loop, and swap it in in the main loop.
+	// Only one reload runs at a time, a change during a reload triggers another one afterwards.
+	reloaded := make(chan reloadedConfig, 1)
+	reloading, reloadPending := false, false
+	startReload := func() {
+		if reloading {
+			reloadPending = true
+			return
+		}
+		reloading = true
+		sdNotify(logger, sdReloading())
+		// only the main loop replaces RuntimeConfig and it waits for this reload before it does
+		current := RuntimeConfig
+		go func() {
+			reloaded <- prepareConfig(current, systemd)
+		}()
+	}
+	finishReload := func(r reloadedConfig) {
+		if r.err != nil {
+			logger.Error("could not load new config, keeping the current config", "err", r.err)
+		} else {
+			swapConfig(r)
+		}
+		reloading = false
+		sdNotify(logger, daemon.SdNotifyReady)
+		if reloadPending {
+			reloadPending = false
+			startReload()
+		}
+	}
+	configChanged := make(chan struct{}, 1)
+	if watcher, err := watchConfigFile(logger, viper.ConfigFileUsed(), configChanged); err != nil {
+		logger.Warn("could not watch config file for changes", "err", err)
+	} else {
+		defer watcher.Close()
+	}
+
+	// systemd socket activation
+	activatedMilter, activatedSocketmap, err := systemdListeners()
+	if err != nil {
+		logger.Crit("error getting sockets from systemd", "err", err)
+		os.Exit(1)
+	}
+	var proxy *milterProxy
+	if activatedMilter != nil {
+		if proxy, err = newMilterProxy(activatedMilter); err != nil {
+			logger.Crit("error creating milter proxy", "err", err)
+			os.Exit(1)
+		}
+		milterProtocol, milterAddress = "unix", proxy.Path()
+	}
+
+	// unix domain sockets we need to clean up on shutdown
+	var sockets []string
+	if milterProtocol == "unix" && proxy == nil {
+		if err = removeStaleSocket(milterAddress); err != nil {
+			logger.Crit("error creating milter", "err", err)
+			os.Exit(1)
+		}
+	}
+	if socketmapProtocol == "unix" && activatedSocketmap == nil {
+		if err = removeStaleSocket(socketmapAddress); err != nil {
+			logger.Crit("error creating socketmap listener", "err", err)
+			os.Exit(1)
 		}
-	})
-	viper.WatchConfig()
+	}
 
+	// mailfilter.New starts serving right away, but we only handle messages after we dropped privileges
+	serving := make(chan struct{})
 	filter, err := mailfilter.New(milterProtocol, milterAddress, func(ctx context.Context, trx mailfilter.Trx) (mailfilter.Decision, error) {
-		RuntimeConfigMutex.RLock()
-		config := RuntimeConfig
-		cache := RuntimeCache
-		RuntimeConfigMutex.RUnlock()
+		<-serving
+		config, cache, release := acquireRuntime()
+		defer release()
 		return srsmilter.Filter(ctx, trx, config, cache)
-	}, mailfilter.WithDecisionAt(mailfilter.DecisionAtEndOfHeaders))
+	}, mailfilter.WithDecisionAt(decisionAt), mailfilter.WithRcptToValidator(func(ctx context.Context, in *mailfilter.RcptToValidationInput) (mailfilter.Decision, error) {
+		<-serving
+		config, _, release := acquireRuntime()
+		defer release()
+		return srsmilter.ValidateRcptTo(ctx, in, config)
+	}))
 	if err != nil {
 		logger.Crit("error creating milter", "err", err)
 		os.Exit(1)
 	}
 
-	smListener, err := net.Listen(socketmapProtocol, socketmapAddress)
-	if err != nil {
-		logger.Crit("error creating socketmap listener", "err", err)
-		os.Exit(1)
+	milterAddr := filter.Addr()
+	if proxy != nil {
+		milterAddr = activatedMilter.Addr()
+	} else if milterProtocol == "unix" {
+		sockets = append(sockets, milterAddress)
+		if err = perms.apply(milterAddress); err != nil {
+			logger.Crit("error setting permissions of milter socket", "err", err)
+			filter.Close()
+			os.Exit(1)
+		}
+	}
+
+	smListener := activatedSocketmap
+	if smListener == nil {
+		smListener, err = net.Listen(socketmapProtocol, socketmapAddress)
+		if err != nil {
+			logger.Crit("error creating socketmap listener", "err", err)
+			os.Exit(1)
+		}
+		if socketmapProtocol == "unix" {
+			sockets = append(sockets, socketmapAddress)
+			if err = perms.apply(socketmapAddress); err != nil {
+				logger.Crit("error setting permissions of socketmap socket", "err", err)
+				filter.Close()
+				_ = smListener.Close()
+				os.Exit(1)
+			}
+		}
+	}
+
+	var metricsListener net.Listener
+	if metricsAddress != "" {
+		if metricsListener, err = net.Listen("tcp", metricsAddress); err != nil {
+			logger.Crit("error creating metrics listener", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if privs != nil {
+		if proxy != nil {
+			if err = proxy.Chown(privs.uid, privs.gid); err != nil {
+				logger.Crit("error changing owner of milter proxy", "err", err)
+				os.Exit(1)
+			}
+		}
+		// we need to reopen these files as the unprivileged user
+		logFile := ""
+		if RuntimeConfig.LogOutput == "file" {
+			logFile = RuntimeConfig.LogFile
+		}
+		if err = privs.chown(logFile, RuntimeConfig.AuditLog); err != nil {
+			logger.Crit("error changing owner of log files", "err", err)
+			os.Exit(1)
+		}
+		if err = privs.drop(); err != nil {
+			logger.Crit("could not drop privileges", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("dropped privileges", "uid", privs.uid, "gid", privs.gid)
 	}
 
+	// start serving only now that we dropped privileges
+	close(serving)
+	if proxy != nil {
+		go proxy.Serve(logger)
+	}
+	smServer := newSocketmapServer(smListener)
 	go func() {
-		socketmap.Serve(smListener, func(_ context.Context, lookup, key string) (string, bool, error) {
-			RuntimeConfigMutex.RLock()
-			config := RuntimeConfig
-			RuntimeConfigMutex.RUnlock()
+		_ = smServer.Serve(func(_ context.Context, lookup, key string) (string, bool, error) {
+			config, _, release := acquireRuntime()
+			defer release()
 			return srsmilter.Socketmap(config, lookup, key)
 		})
 	}()
 
-	logger.Info("ready", "milterProto", filter.Addr().Network(), "milterAddr", filter.Addr().String(), "socketmapProto", smListener.Addr().Network(), "socketmapAddr", smListener.Addr().String())
-
 	// quit when milter quits
-	filter.Wait()
+	milterDone := make(chan struct{})
+	go func() {
+		filter.Wait()
+		close(milterDone)
+	}()
+
+	var httpServer *http.Server
+	if metricsListener != nil {
+		httpServer = serveHttp(metricsListener, []healthCheck{
+			{"db", func(ctx context.Context) error {
+				config, _, release := acquireRuntime()
+				defer release()
+				return config.CheckDb(ctx)
+			}},
+			{"spf", func(ctx context.Context) error {
+				_, cache, release := acquireRuntime()
+				defer release()
+				return cache.CheckSpf(ctx)
+			}},
+			// do not open milter sessions for health checks, only check that the milter server still runs
+			{"milter", runningCheck(milterDone)},
+			{"socketmap", listenerCheck(smListener.Addr())},
+		})
+		logger.Info("serving metrics", "metricsAddr", metricsListener.Addr().String())
+	}
+
+	logger.Info("ready", "milterProto", milterAddr.Network(), "milterAddr", milterAddr.String(), "socketmapProto", smListener.Addr().Network(), "socketmapAddr", smListener.Addr().String(), "socketActivation", activatedMilter != nil || activatedSocketmap != nil)
+	sdNotify(logger, daemon.SdNotifyReady)
+	watchdog := sdWatchdog(logger)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	for {
+		select {
+		case <-watchdog:
+			sdNotify(logger, daemon.SdNotifyWatchdog)
+		case <-configChanged:
+			logger.Info("reloading config", "reason", "file changed")
+			startReload()
+		case r := <-reloaded:
+			finishReload(r)
+		case <-milterDone:
+			logger.Warn("milter server stopped")
+			shutdown(logger, drainTimeout, filter, proxy, smServer, httpServer, sockets, logCloser)
+			return
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				logger.Info("reloading config", "signal", sig)
+				startReload()
+			case syscall.SIGUSR1:
+				RuntimeConfigMutex.RLock()
+				cache := RuntimeCache
+				RuntimeConfigMutex.RUnlock()
+				logger.Info("stats", "milterCount", filter.MilterCount())
+				cache.LogStats()
+			case syscall.SIGUSR2:
+				RuntimeConfigMutex.RLock()
+				if f, ok := logCloser.(*logFile); ok {
+					if err = f.Reopen(); err != nil {
+						logger.Error("could not reopen log file", "err", err)
+					}
+				}
+				RuntimeConfigMutex.RUnlock()
+			default:
+				logger.Info("shutting down", "signal", sig, "drainTimeout", drainTimeout)
+				shutdown(logger, drainTimeout, filter, proxy, smServer, httpServer, sockets, logCloser)
+				return
+			}
+		}
+	}
+}
+
+// shutdown stops accepting new connections, waits at most drainTimeout for running milter sessions and
+// socketmap requests, removes our unix domain sockets and then closes the database connections and the audit log of
+// the current config. Closing logCloser (e.g. the log file) is the very last step.
+func shutdown(logger log15.Logger, drainTimeout time.Duration, filter *mailfilter.MailFilter, proxy *milterProxy, smServer *socketmapServer, httpServer *http.Server, sockets []string, logCloser io.Closer) {
+	sdNotify(logger, daemon.SdNotifyStopping)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if proxy != nil {
+		_ = proxy.Close()
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := filter.Shutdown(ctx); err != nil {
+			logger.Warn("milter sessions did not finish in time", "err", err)
+			filter.Close()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := smServer.Shutdown(ctx); err != nil {
+			logger.Warn("socketmap requests did not finish in time", "err", err)
+		}
+	}()
+	wg.Wait()
+	if proxy != nil {
+		if err := proxy.Cleanup(); err != nil {
+			logger.Warn("could not clean up milter proxy", "err", err)
+		}
+	}
+	for _, path := range sockets {
+		if err := removeSocket(path); errors.Is(err, fs.ErrPermission) {
+			// we dropped privileges, removeStaleSocket takes care of it on the next start
+			logger.Info("not allowed to remove socket, it gets removed on the next start", "path", path)
+		} else if err != nil {
+			logger.Warn("could not remove socket", "path", path, "err", err)
+		}
+	}
+	if httpServer != nil {
+		_ = httpServer.Close()
+	}
+	// sessions that did not finish in time might still use the config
+	RuntimeConfigMutex.Lock()
+	defer RuntimeConfigMutex.Unlock()
+	released := make(chan struct{})
+	go func() {
+		RuntimeUsers.Wait()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-ctx.Done():
+	}
+	RuntimeCache.Stop()
+	if err := RuntimeConfig.Close(); err != nil {
+		logger.Warn("could not close config", "err", err)
+	}
+	logger.Info("stopped")
+	if logCloser != nil {
+		_ = logCloser.Close()
+	}
 }
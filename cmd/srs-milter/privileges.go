@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// privileges are the user and groups we switch to after we bound our sockets and opened the config
+type privileges struct {
+	uid, gid int
+	groups   []int
+}
+
+// lookupPrivileges resolves the -user and -group flags. Without a group we use the primary group of the user.
+// It returns nil when both are empty.
+func lookupPrivileges(userName, groupName string) (*privileges, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	p := &privileges{uid: syscall.Getuid(), gid: syscall.Getgid()}
+	if userName != "" {
+		// resolve the name like -socketOwner does, we need the user entry for its groups
+		uid, err := lookupUid(userName)
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+		u, err := user.LookupId(strconv.Itoa(uid))
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+		p.uid = uid
+		if p.gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, err
+		}
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.Atoi(id); err == nil {
+					p.groups = append(p.groups, gid)
+				}
+			}
+		}
+	}
+	if groupName != "" {
+		var err error
+		if p.gid, err = lookupGid(groupName); err != nil {
+			return nil, fmt.Errorf("unknown group %q", groupName)
+		}
+		p.groups = nil
+	}
+	if len(p.groups) == 0 {
+		p.groups = []int{p.gid}
+	}
+	return p, nil
+}
+
+// drop switches to the user and groups of p. The order matters: after setuid we would not be allowed to change our groups.
+func (p *privileges) drop() error {
+	if err := syscall.Setgroups(p.groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(p.gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(p.uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if syscall.Geteuid() != p.uid || syscall.Getegid() != p.gid {
+		return fmt.Errorf("still running as %d:%d", syscall.Geteuid(), syscall.Getegid())
+	}
+	return nil
+}
+
+// chown changes the owner of the files we need to reopen after dropping privileges (e.g. the log file) to p.
+// Empty paths get ignored.
+func (p *privileges) chown(paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func Test_lookupPrivileges(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		group   string
+		wantUid int
+		wantGid int
+		wantNil bool
+		wantErr bool
+	}{
+		{"none", "", "", 0, 0, true, false},
+		{"name", "root", "", 0, 0, false, false},
+		{"id", "0", "", 0, 0, false, false},
+		{"group-id", "root", "12345", 0, 12345, false, false},
+		{"unknown-user", "srs-milter-does-not-exist", "", 0, 0, false, true},
+		{"unknown-id", "987654", "", 0, 0, false, true},
+		{"unknown-group", "root", "srs-milter-does-not-exist", 0, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupPrivileges(tt.user, tt.group)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupPrivileges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("lookupPrivileges() = %v, want nil %v", got, tt.wantNil)
+			}
+			if got != nil && (got.uid != tt.wantUid || got.gid != tt.wantGid) {
+				t.Errorf("lookupPrivileges() = %d:%d, want %d:%d", got.uid, got.gid, tt.wantUid, tt.wantGid)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// socketPerms are the permissions we set on the unix domain sockets we create
+type socketPerms struct {
+	mode     fs.FileMode
+	hasMode  bool
+	uid, gid int
+}
+
+// parseSocketPerms parses the -socketMode, -socketOwner and -socketGroup flags. Empty values keep the defaults.
+func parseSocketPerms(mode, owner, group string) (socketPerms, error) {
+	p := socketPerms{uid: -1, gid: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return p, fmt.Errorf("invalid socket mode %q", mode)
+		}
+		p.mode, p.hasMode = fs.FileMode(m), true
+	}
+	var err error
+	if owner != "" {
+		if p.uid, err = lookupUid(owner); err != nil {
+			return p, err
+		}
+	}
+	if group != "" {
+		if p.gid, err = lookupGid(group); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// apply sets mode and ownership of the unix domain socket at path
+func (p socketPerms) apply(path string) error {
+	if p.uid >= 0 || p.gid >= 0 {
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	if p.hasMode {
+		return os.Chmod(path, p.mode)
+	}
+	return nil
+}
+
+// lookupUid returns the numeric user id of the username or user id name
+func lookupUid(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGid returns the numeric group id of the group name or group id name
+func lookupGid(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// removeStaleSocket removes the unix domain socket at path when no process listens on it anymore (e.g. after a crash).
+// It refuses to remove other files and sockets that are still in use.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a unix domain socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// removeSocket removes the unix domain socket at path if it still exists
+func removeSocket(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
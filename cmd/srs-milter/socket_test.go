@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_removeStaleSocket(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, path string)
+		wantErr    bool
+		wantExists bool
+	}{
+		{"missing", func(t *testing.T, path string) {}, false, false},
+		{"regular-file", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, true, true},
+		{"stale-socket", func(t *testing.T, path string) {
+			ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln.SetUnlinkOnClose(false)
+			_ = ln.Close()
+		}, false, false},
+		{"in-use", func(t *testing.T, path string) {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = ln.Close() })
+		}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.sock")
+			tt.setup(t, path)
+			if err := removeStaleSocket(path); (err != nil) != tt.wantErr {
+				t.Errorf("removeStaleSocket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Lstat(path); (err == nil) != tt.wantExists {
+				t.Errorf("file exists = %v, want %v", err == nil, tt.wantExists)
+			}
+		})
+	}
+}
+
+func Test_removeSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	if err := removeSocket(path); err != nil {
+		t.Errorf("removeSocket() of missing file error = %v", err)
+	}
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeSocket(path); err != nil {
+		t.Errorf("removeSocket() error = %v", err)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		t.Errorf("file still exists")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/d--j/go-socketmap"
+)
+
+// socketmapServer serves socketmap requests and keeps track of its connections and running requests,
+// so that it can shut down gracefully.
+type socketmapServer struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	active int
+}
+
+func newSocketmapServer(ln net.Listener) *socketmapServer {
+	return &socketmapServer{Listener: ln, conns: make(map[net.Conn]struct{})}
+}
+
+// Accept implements [net.Listener] and tracks the accepted connections
+func (s *socketmapServer) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = struct{}{}
+	return &socketmapConn{Conn: conn, s: s}, nil
+}
+
+// Serve serves socketmap requests with handler until the listener gets closed
+func (s *socketmapServer) Serve(handler socketmap.Handler) error {
+	return socketmap.Serve(s, func(ctx context.Context, lookup, key string) (string, bool, error) {
+		s.mu.Lock()
+		s.active++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.active--
+			s.mu.Unlock()
+		}()
+		return handler(ctx, lookup, key)
+	})
+}
+
+// Shutdown stops accepting new connections, waits until all running requests are done (or ctx is done)
+// and then closes all connections.
+func (s *socketmapServer) Shutdown(ctx context.Context) error {
+	err := s.Listener.Close()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		active := s.active
+		s.mu.Unlock()
+		if active == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+			continue
+		}
+		break
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+	return err
+}
+
+type socketmapConn struct {
+	net.Conn
+	s *socketmapServer
+}
+
+func (c *socketmapConn) Close() error {
+	c.s.mu.Lock()
+	delete(c.s.conns, c.Conn)
+	c.s.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// socketmapLookup sends one socketmap request over conn and returns the raw netstring reply
+func socketmapLookup(conn net.Conn, lookup, key string) (string, error) {
+	request := lookup + " " + key
+	if _, err := fmt.Fprintf(conn, "%d:%s,", len(request), request); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString(',')
+}
+
+func Test_socketmapServer_Shutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		request bool // a request is running when we shut down
+		finish  bool // the running request finishes before the timeout
+		wantErr error
+	}{
+		{"idle", false, false, nil},
+		{"running-request", true, true, nil},
+		{"timeout", true, false, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "socketmap.sock")
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newSocketmapServer(ln)
+			started := make(chan struct{})
+			release := make(chan struct{})
+			t.Cleanup(func() { close(release) })
+			go func() {
+				_ = s.Serve(func(_ context.Context, lookup, key string) (string, bool, error) {
+					if key == "slow" {
+						close(started)
+						<-release
+					}
+					return key, true, nil
+				})
+			}()
+			// an idle connection that Shutdown needs to close
+			idle, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer idle.Close()
+			if _, err = socketmapLookup(idle, "test", "fast"); err != nil {
+				t.Fatal(err)
+			}
+			result := make(chan error, 1)
+			if tt.request {
+				slow, err := net.Dial("unix", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer slow.Close()
+				go func() {
+					_, err := socketmapLookup(slow, "test", "slow")
+					result <- err
+				}()
+				<-started
+			}
+			if tt.finish {
+				time.AfterFunc(50*time.Millisecond, func() { release <- struct{}{} })
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			if err := s.Shutdown(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Shutdown() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.finish {
+				if err := <-result; err != nil {
+					t.Errorf("running request error = %v", err)
+				}
+			}
+			if _, err = socketmapLookup(idle, "test", "fast"); err == nil {
+				t.Errorf("idle connection still open")
+			}
+			s.mu.Lock()
+			conns := len(s.conns)
+			s.mu.Unlock()
+			if conns != 0 {
+				t.Errorf("open connections = %d, want 0", conns)
+			}
+			if _, err := net.Dial("unix", path); err == nil {
+				t.Errorf("server still accepts connections")
+			}
+		})
+	}
+}
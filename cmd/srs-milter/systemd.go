@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/inconshreveable/log15"
+)
+
+// File descriptor names (FileDescriptorName= in the .socket units) of the sockets systemd can pass to us
+const (
+	systemdMilterName    = "milter"
+	systemdSocketmapName = "socketmap"
+)
+
+// systemdListeners returns the milter and socketmap listeners that systemd passed to us via socket activation.
+// The listeners are nil when systemd did not pass a socket with the respective name.
+func systemdListeners() (milter net.Listener, socketmap net.Listener, err error) {
+	named, err := activation.ListenersWithNames()
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, listeners := range named {
+		for i, ln := range listeners {
+			switch {
+			case ln == nil:
+				err = fmt.Errorf("socket %q is not a stream socket", name)
+			case i == 0 && name == systemdMilterName:
+				milter = ln
+			case i == 0 && name == systemdSocketmapName:
+				socketmap = ln
+			default:
+				_ = ln.Close()
+				err = fmt.Errorf("unexpected socket %q from systemd", name)
+			}
+		}
+	}
+	return milter, socketmap, err
+}
+
+// sdNotify sends state to systemd. It does nothing when we were not started by systemd.
+func sdNotify(logger log15.Logger, state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		logger.Warn("could not notify systemd", "state", state, "err", err)
+	}
+}
+
+// sdWatchdog returns a channel that ticks in half of the watchdog interval systemd expects us to ping it.
+// It returns nil when the watchdog is not enabled.
+func sdWatchdog(logger log15.Logger) <-chan time.Time {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logger.Warn("could not determine systemd watchdog interval", "err", err)
+		return nil
+	}
+	if interval == 0 {
+		return nil
+	}
+	return time.NewTicker(interval / 2).C
+}
+
+// milterProxy forwards the connections of a socket that systemd passed to us to our milter server.
+// It only exists because [mailfilter.New] of go-milter v0.10.1 takes a network and an address and always creates
+// its own socket – it cannot serve on a [net.Listener] we already have. So we let it listen on a private unix socket.
+// Drop the proxy and pass the systemd listener directly once go-milter accepts a net.Listener.
+type milterProxy struct {
+	ln  net.Listener
+	dir string
+	wg  sync.WaitGroup
+}
+
+// newMilterProxy creates a private directory for the unix socket of the milter server.
+// Use [milterProxy.Serve] to start forwarding once the milter server listens on [milterProxy.Path].
+func newMilterProxy(ln net.Listener) (*milterProxy, error) {
+	dir, err := os.MkdirTemp("", "srs-milter")
+	if err != nil {
+		return nil, err
+	}
+	return &milterProxy{ln: ln, dir: dir}, nil
+}
+
+// Path returns the path of the unix socket the milter server should listen on
+func (p *milterProxy) Path() string {
+	return filepath.Join(p.dir, "milter.sock")
+}
+
+// Serve forwards all connections until the listener gets closed
+func (p *milterProxy) Serve(logger log15.Logger) {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer conn.Close()
+			backend, err := net.Dial("unix", p.Path())
+			if err != nil {
+				logger.Error("could not connect to milter server", "err", err)
+				return
+			}
+			defer backend.Close()
+			done := make(chan struct{}, 2)
+			go func() {
+				_, _ = io.Copy(backend, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				_, _ = io.Copy(conn, backend)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
+
+// Chown changes the owner of the private directory, so that the proxy still can connect to the milter server
+// after we dropped privileges
+func (p *milterProxy) Chown(uid, gid int) error {
+	if err := os.Chown(p.dir, uid, gid); err != nil {
+		return err
+	}
+	return os.Chown(p.Path(), uid, gid)
+}
+
+// Close stops accepting new connections
+func (p *milterProxy) Close() error {
+	return p.ln.Close()
+}
+
+// Cleanup waits for all forwarded connections to end and removes the private directory.
+// Call it after the milter server was shut down.
+func (p *milterProxy) Cleanup() error {
+	p.wg.Wait()
+	return os.RemoveAll(p.dir)
+}
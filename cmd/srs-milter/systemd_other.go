@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "github.com/coreos/go-systemd/v22/daemon"
+
+// sdReloading returns the state that tells systemd that we reload our config
+func sdReloading() string {
+	return daemon.SdNotifyReloading
+}
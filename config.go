@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"net/mail"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/d--j/go-milter/mailfilter/addr"
 	"github.com/inconshreveable/log15"
@@ -14,11 +17,8 @@ import (
 type Domain string
 
 func ToDomain(domain string) Domain {
-	ascii, err := idna.Lookup.ToASCII(domain)
-	if err != nil {
-		return Domain(domain)
-	}
-	return Domain(ascii)
+	d, _ := ParseDomain(domain)
+	return d
 }
 
 func (d Domain) String() string {
@@ -34,85 +34,253 @@ func (d Domain) Unicode() string {
 }
 
 type Configuration struct {
-	SrsDomain      Domain
-	LocalDomains   []Domain
-	SrsKeys        []string
-	LocalIps       []net.IP
-	LogLevel       uint
-	DbDriver       string
-	DbDSN          string
-	DbForwardQuery string
-	db             *sql.DB
-	localDomainMap map[string]bool
+	SrsDomain                   Domain
+	LocalDomains                []Domain
+	LocalDomainsMatchSubdomains bool
+	SrsKeys                     []string
+	LocalIps                    []net.IP
+	LogLevel                    LogLevel
+	LogLevels                   map[string]LogLevel
+	LogFormat                   string
+	LogOutput                   string
+	LogFile                     string
+	DbDriver                    string
+	DbDSN                       string
+	DbForwardQuery              string
+	RecipientDelimiters         string
+	ForwardCatchAll             bool
+	DbCatchAllQuery             string
+	CatchAllKey                 string
+	LocalDomainsQuery           string
+	LocalDomainsFile            string
+	LocalDomainsRefresh         time.Duration
+	NeverRewriteSenders         []string
+	AlwaysRewriteSenders        []string
+	RecipientDomainPolicies     []RecipientDomainPolicy
+	SkipRewriteRules            []SkipRewriteRule
+	SplitMixedRecipients        bool
+	SplitRelayAddr              string
+	SplitTimeout                time.Duration
+	TraceHeader                 string
+	TraceHeaderUnlessDkim       bool
+	StripHeaders                []string
+	TrustedNetworks             []string
+	VerifyDkim                  bool
+	ReverseHeaders              []string
+	ReverseDsn                  bool
+	BounceMode                  bool
+	BounceSenders               []string
+	HealthSpfDomain             Domain
+	AuditLog                    string
+	AuditLogMaxSize             int
+	AuditLogMaxBackups          int
+	AuditLogMaxAge              int
+	AuditLogCompress            bool
+	DryRun                      bool
+	DryRunDomains               []Domain
+	DkimLookupTXT               func(domain string) ([]string, error) `mapstructure:"-"`
+	db                          *sql.DB
+	localDomains                *domainMatcher
+	dynamicLocalDomains         atomic.Pointer[domainMatcher]
+	done                        chan struct{}
+	neverRewriteSenders         *addressMatcher
+	alwaysRewriteSenders        *addressMatcher
+	recipientDomainPolicies     []recipientDomainPolicy
+	skipRewriteRules            []skipRewriteRule
+	stripHeaders                map[string]bool
+	reverseHeaders              map[string]bool
+	bounceSenders               *bounceSenders
+	trustedNetworks             []*net.IPNet
+	auditLog                    *auditWriter
+	dryRunDomains               *domainMatcher
 }
 
 func (c *Configuration) Setup() error {
-	c.localDomainMap = make(map[string]bool)
+	c.localDomains = newDomainMatcher(c.LocalDomainsMatchSubdomains)
 	for _, d := range c.LocalDomains {
-		c.localDomainMap[d.String()] = true
+		if err := c.localDomains.Add(d); err != nil {
+			return err
+		}
+	}
+	var err error
+	if err = validateLogLevels(c.LogLevels); err != nil {
+		return err
+	}
+	if c.neverRewriteSenders, err = newAddressMatcher(c.NeverRewriteSenders); err != nil {
+		return err
+	}
+	if c.alwaysRewriteSenders, err = newAddressMatcher(c.AlwaysRewriteSenders); err != nil {
+		return err
+	}
+	if c.recipientDomainPolicies, err = newRecipientDomainPolicies(c.RecipientDomainPolicies); err != nil {
+		return err
+	}
+	if c.skipRewriteRules, err = newSkipRewriteRules(c.SkipRewriteRules); err != nil {
+		return err
 	}
-	if c.DbDriver != "" && c.DbDSN != "" && c.DbForwardQuery != "" {
+	c.stripHeaders = newHeaderKeys(c.StripHeaders)
+	if len(c.ReverseHeaders) > 0 {
+		c.reverseHeaders = newHeaderKeys(c.ReverseHeaders)
+	} else {
+		c.reverseHeaders = newHeaderKeys(defaultReverseHeaders)
+	}
+	if c.bounceSenders, err = newBounceSenders(c.BounceSenders); err != nil {
+		return err
+	}
+	c.trustedNetworks = nil
+	for _, n := range c.TrustedNetworks {
+		network, err := parseNetwork(n)
+		if err != nil {
+			return err
+		}
+		c.trustedNetworks = append(c.trustedNetworks, network)
+	}
+	c.auditLog = c.newAuditLog()
+	c.dryRunDomains = nil
+	if len(c.DryRunDomains) > 0 {
+		c.dryRunDomains = newDomainMatcher(false)
+		for _, d := range c.DryRunDomains {
+			if err := c.dryRunDomains.Add(d); err != nil {
+				return err
+			}
+		}
+	}
+	if c.DbDriver != "" && c.DbDSN != "" && (c.DbForwardQuery != "" || c.LocalDomainsQuery != "") {
 		db, err := sql.Open(c.DbDriver, c.DbDSN)
 		if err != nil {
 			return err
 		}
 		err = db.Ping()
 		if err != nil {
+			_ = db.Close()
 			return err
 		}
 		c.db = db
 	}
+	if c.hasDynamicLocalDomains() {
+		m, count, err := c.loadDynamicLocalDomains()
+		if err != nil {
+			// do not leak the connection pool of a config that we never use
+			if c.db != nil {
+				_ = c.db.Close()
+				c.db = nil
+			}
+			return err
+		}
+		c.dynamicLocalDomains.Store(m)
+		Log.Debug("loaded local domains", "sub", "domains", "count", count)
+		c.done = make(chan struct{})
+		go c.refreshDynamicLocalDomains(c.done)
+	}
+	return nil
+}
+
+// Close stops refreshing the dynamic local domains and closes the database connection.
+// You should not use c after calling Close.
+func (c *Configuration) Close() error {
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	if c.auditLog != nil {
+		_ = c.auditLog.release()
+	}
+	if c.db != nil {
+		return c.db.Close()
+	}
 	return nil
 }
 
 func (c *Configuration) IsLocalDomain(asciiDomain string) bool {
-	if c.localDomainMap[asciiDomain] {
+	if c.localDomains != nil && c.localDomains.Match(asciiDomain) {
+		return true
+	}
+	if dynamic := c.dynamicLocalDomains.Load(); dynamic != nil && dynamic.Match(asciiDomain) {
 		return true
 	}
 	return false
 }
 
-func emailWithoutExtension(local string, asciiDomain string) string {
-	plus := strings.IndexByte(local, '+')
-	if plus < 1 {
+// defaultRecipientDelimiters is used when RecipientDelimiters is not set
+const defaultRecipientDelimiters = "+"
+
+// defaultCatchAllKey is used when CatchAllKey is not set. %d gets replaced with the ASCII domain.
+const defaultCatchAllKey = "@%d"
+
+// emailWithoutExtension strips the address extension from local.
+// Like Postfix' recipient_delimiter, every character of delimiters is a possible delimiter and
+// the extension starts at the first delimiter found in local.
+func emailWithoutExtension(local string, asciiDomain string, delimiters string) string {
+	pos := strings.IndexAny(local, delimiters)
+	if pos < 1 {
 		return fmt.Sprintf("%s@%s", local, asciiDomain)
 	}
-	return fmt.Sprintf("%s@%s", local[:plus], asciiDomain)
+	return fmt.Sprintf("%s@%s", local[:pos], asciiDomain)
+}
+
+// forwardLookupKeys returns the keys we query for email in the order we query them:
+// the full address first and then the address without its extension (like Postfix does).
+func (c *Configuration) forwardLookupKeys(email *addr.RcptTo) []string {
+	delimiters := c.RecipientDelimiters
+	if delimiters == "" {
+		delimiters = defaultRecipientDelimiters
+	}
+	full := fmt.Sprintf("%s@%s", email.Local(), email.AsciiDomain())
+	stripped := emailWithoutExtension(email.Local(), email.AsciiDomain(), delimiters)
+	if full == stripped {
+		return []string{full}
+	}
+	return []string{full, stripped}
+}
+
+// catchAllLookupKey returns the key we query for the domain catch-all of email
+func (c *Configuration) catchAllLookupKey(email *addr.RcptTo) string {
+	key := c.CatchAllKey
+	if key == "" {
+		key = defaultCatchAllKey
+	}
+	return strings.ReplaceAll(key, "%d", email.AsciiDomain())
 }
 
 func (c *Configuration) ResolveForward(email *addr.RcptTo) (emails []*addr.RcptTo) {
 	seen := make(map[string]bool)
-	return c.resolveForward(email, seen)
+	return c.resolveForward(email, seen, c.ForwardCatchAll)
 }
 
-func (c *Configuration) resolveForward(email *addr.RcptTo, seen map[string]bool) (emails []*addr.RcptTo) {
-	if c.db == nil {
+// resolveForward resolves email recursively. We only look up the domain catch-all when catchAll is true
+// (for the original recipient) – a forward target without own forward is a real mailbox.
+func (c *Configuration) resolveForward(email *addr.RcptTo, seen map[string]bool, catchAll bool) (emails []*addr.RcptTo) {
+	if c.db == nil || c.DbForwardQuery == "" {
 		return []*addr.RcptTo{email}
 	}
-	rows, err := c.db.Query(c.DbForwardQuery, emailWithoutExtension(email.Local(), email.AsciiDomain()))
-	if err != nil {
-		Log.Warn("query error looking up forwards", "email", email.Addr, "err", err)
-		return []*addr.RcptTo{email}
-	}
-	defer rows.Close()
-	for rows.Next() {
-		dest := ""
-		if err = rows.Scan(&dest); err != nil {
-			Log.Warn("scan error looking up forwards", "email", email.Addr, "err", err)
+	var addresses []*mail.Address
+	for _, key := range c.forwardLookupKeys(email) {
+		var ok bool
+		addresses, ok = c.queryForward(email, c.DbForwardQuery, key)
+		if !ok {
 			return []*addr.RcptTo{email}
 		}
-		addresses, err := parseAddressList(dest)
-		if err != nil {
-			Log.Warn("parse error looking up forwards", "email", email.Addr, "dest", dest, "err", err)
+		if len(addresses) > 0 {
+			break
+		}
+	}
+	if len(addresses) == 0 && catchAll && email.AsciiDomain() != "" {
+		query := c.DbCatchAllQuery
+		if query == "" {
+			query = c.DbForwardQuery
+		}
+		var ok bool
+		addresses, ok = c.queryForward(email, query, c.catchAllLookupKey(email))
+		if !ok {
 			return []*addr.RcptTo{email}
 		}
-		for _, a := range addresses {
-			Log.Debug("forward res", "from", email.Addr, "to", a.Address, "seen", seen[a.Address])
-			if !(seen[a.Address]) {
-				seen[a.Address] = true
-				for _, r := range c.resolveForward(addr.NewRcptTo(a.Address, "", email.Transport()), seen) {
-					emails = append(emails, r)
-				}
+	}
+	for _, a := range addresses {
+		Log.Debug("forward res", "sub", "forward", "from", email.Addr, "to", a.Address, "seen", seen[a.Address])
+		if !(seen[a.Address]) {
+			seen[a.Address] = true
+			for _, r := range c.resolveForward(addr.NewRcptTo(a.Address, "", email.Transport()), seen, false) {
+				emails = append(emails, r)
 			}
 		}
 	}
@@ -122,6 +290,42 @@ func (c *Configuration) resolveForward(email *addr.RcptTo, seen map[string]bool)
 	return []*addr.RcptTo{email}
 }
 
+// queryForward runs query with key and returns all forward destinations it found.
+// ok is false when there was an error and the lookup should be aborted.
+func (c *Configuration) queryForward(email *addr.RcptTo, query, key string) (addresses []*mail.Address, ok bool) {
+	start := time.Now()
+	defer func() {
+		metricForwardQueryDuration.Observe(time.Since(start).Seconds())
+		if !ok {
+			metricForwardQueryErrors.Inc()
+		}
+	}()
+	rows, err := c.db.Query(query, key)
+	if err != nil {
+		Log.Warn("query error looking up forwards", "sub", "forward", "email", email.Addr, "key", key, "err", err)
+		return nil, false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		dest := ""
+		if err = rows.Scan(&dest); err != nil {
+			Log.Warn("scan error looking up forwards", "sub", "forward", "email", email.Addr, "key", key, "err", err)
+			return nil, false
+		}
+		parsed, err := parseAddressList(dest)
+		if err != nil {
+			Log.Warn("parse error looking up forwards", "sub", "forward", "email", email.Addr, "key", key, "dest", dest, "err", err)
+			return nil, false
+		}
+		addresses = append(addresses, parsed...)
+	}
+	if err = rows.Err(); err != nil {
+		Log.Warn("query error looking up forwards", "sub", "forward", "email", email.Addr, "key", key, "err", err)
+		return nil, false
+	}
+	return addresses, true
+}
+
 var Log = log15.New()
 
 func init() {
@@ -1,9 +1,140 @@
 package srsmilter
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
 	"testing"
+
+	"github.com/d--j/go-milter/mailfilter/addr"
 )
 
+// fakeDb is a minimal database/sql driver that answers every query with the rows stored for the query and its only argument
+type fakeDb struct {
+	mu    sync.Mutex
+	data  map[string]map[string][]string
+	conns int // number of open connections
+}
+
+var fakeDbs = map[string]*fakeDb{}
+var fakeDbsMutex sync.Mutex
+
+func init() {
+	sql.Register("srsmilter-fake", fakeDriver{})
+}
+
+// newFakeDb registers data under a fresh DSN and returns it.
+// data maps queries to keys to result rows. Unknown queries return an error.
+func newFakeDb(t *testing.T, data map[string]map[string][]string) string {
+	fakeDbsMutex.Lock()
+	defer fakeDbsMutex.Unlock()
+	dsn := t.Name()
+	fakeDbs[dsn] = &fakeDb{data: data}
+	t.Cleanup(func() {
+		fakeDbsMutex.Lock()
+		defer fakeDbsMutex.Unlock()
+		delete(fakeDbs, dsn)
+	})
+	return dsn
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakeDbsMutex.Lock()
+	defer fakeDbsMutex.Unlock()
+	db := fakeDbs[dsn]
+	if db == nil {
+		return nil, errors.New("unknown fake db")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.conns++
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDb
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.conns--
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+type fakeStmt struct {
+	db    *fakeDb
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(_ []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	table, ok := s.db.data[s.query]
+	if !ok {
+		return nil, errors.New("unknown query")
+	}
+	key := ""
+	if len(args) > 0 {
+		key, _ = args[0].(string)
+	}
+	return &fakeRows{rows: table[key]}, nil
+}
+
+// fakeRowError makes fakeRows fail when it reaches this row
+const fakeRowError = "\x00error"
+
+type fakeRows struct {
+	rows []string
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"destination"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	if r.rows[r.pos] == fakeRowError {
+		return errors.New("row error")
+	}
+	dest[0] = r.rows[r.pos]
+	r.pos++
+	return nil
+}
+
 func toDomainSlice(in []string) (out []Domain) {
 	for _, i := range in {
 		out = append(out, ToDomain(i))
@@ -11,6 +142,29 @@ func toDomainSlice(in []string) (out []Domain) {
 	return
 }
 
+// testConfig fills in the common test settings that c leaves empty, sets it up
+// and closes it when the test finishes.
+func testConfig(t *testing.T, c *Configuration) *Configuration {
+	t.Helper()
+	if c.SrsDomain == "" {
+		c.SrsDomain = "srs.example.com"
+	}
+	if c.LocalDomains == nil {
+		c.LocalDomains = []Domain{ToDomain("example.com")}
+	}
+	if c.SrsKeys == nil {
+		c.SrsKeys = []string{"secret-key"}
+	}
+	if c.LocalIps == nil {
+		c.LocalIps = []net.IP{net.ParseIP("8.8.8.8")}
+	}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
 func TestConfiguration_HasLocalDomain(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -27,6 +181,9 @@ func TestConfiguration_HasLocalDomain(t *testing.T) {
 		{"multiple3", toDomainSlice([]string{"example.com", "example.net", "example.org"}), "example.org", true},
 		{"multiple4", toDomainSlice([]string{"example.com", "example.net", "example.org"}), "example.biz", false},
 		{"idna1", toDomainSlice([]string{"näkkileipä.example.com", "example.net", "example.org"}), "xn--nkkileip-0zah.example.com", true},
+		{"wildcard1", toDomainSlice([]string{"*.example.com"}), "sub.example.com", true},
+		{"wildcard2", toDomainSlice([]string{"*.example.com"}), "example.com", false},
+		{"regexp1", toDomainSlice([]string{"/^c[0-9]+\\.example\\.com$/"}), "c1.example.com", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -85,22 +242,127 @@ func Test_emailWithoutExtension(t *testing.T) {
 	type args struct {
 		local       string
 		asciiDomain string
+		delimiters  string
 	}
 	tests := []struct {
 		name string
 		args args
 		want string
 	}{
-		{"empty", args{"", ""}, "@"},
-		{"without", args{"local", "example.com"}, "local@example.com"},
-		{"with", args{"local+hi", "example.com"}, "local@example.com"},
-		{"double", args{"local+hi+ho", "example.com"}, "local@example.com"},
+		{"empty", args{"", "", "+"}, "@"},
+		{"without", args{"local", "example.com", "+"}, "local@example.com"},
+		{"with", args{"local+hi", "example.com", "+"}, "local@example.com"},
+		{"double", args{"local+hi+ho", "example.com", "+"}, "local@example.com"},
+		{"leading", args{"+local", "example.com", "+"}, "+local@example.com"},
+		{"dash-not-delimiter", args{"local-hi", "example.com", "+"}, "local-hi@example.com"},
+		{"dash", args{"local-hi", "example.com", "-"}, "local@example.com"},
+		{"multi1", args{"local-hi+ho", "example.com", "+-"}, "local@example.com"},
+		{"multi2", args{"local+hi-ho", "example.com", "+-"}, "local@example.com"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := emailWithoutExtension(tt.args.local, tt.args.asciiDomain); got != tt.want {
+			if got := emailWithoutExtension(tt.args.local, tt.args.asciiDomain, tt.args.delimiters); got != tt.want {
 				t.Errorf("emailWithoutExtension() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestConfiguration_forwardLookupKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		delimiters string
+		email      string
+		want       []string
+	}{
+		{"plain", "", "user@example.com", []string{"user@example.com"}},
+		{"default", "", "user+tag@example.com", []string{"user+tag@example.com", "user@example.com"}},
+		{"default-dash", "", "user-tag@example.com", []string{"user-tag@example.com"}},
+		{"dash", "+-", "user-tag@example.com", []string{"user-tag@example.com", "user@example.com"}},
+		{"idna", "+-", "user-tag@näkkileipä.example.com", []string{"user-tag@xn--nkkileip-0zah.example.com", "user@xn--nkkileip-0zah.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Configuration{RecipientDelimiters: tt.delimiters}
+			if got := c.forwardLookupKeys(addr.NewRcptTo(tt.email, "", "")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("forwardLookupKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfiguration_ResolveForward(t *testing.T) {
+	const forwardQuery = "forward"
+	const catchAllQuery = "catch-all"
+	data := map[string]map[string][]string{
+		forwardQuery: {
+			"user@example.com":     {"user@example.net"},
+			"user-tag@example.com": {"tagged@example.net"},
+			"list@example.com":     {"one@example.com, two@example.net", "three@example.org"},
+			"one@example.com":      {"one@example.org"},
+			"loop@example.com":     {"loop@example.com"},
+			"broken@example.com":   {"(broken"},
+			"partial@example.org":  {fakeRowError},
+			"alias@example.com":    {"mailbox@example.org"},
+			"@example.org":         {"catch-all@example.net"},
+			"example.biz":          {"catch-all-biz@example.net"},
+		},
+		catchAllQuery: {
+			"@example.com": {"catch-all-query@example.net"},
+		},
+	}
+	tests := []struct {
+		name       string
+		delimiters string
+		catchAll   bool
+		query      string // DbCatchAllQuery, or DbForwardQuery when catchAll is false
+		key        string
+		email      string
+		want       []string
+	}{
+		{"not-found", "", false, "", "", "nobody@example.com", []string{"nobody@example.com"}},
+		{"found", "", false, "", "", "user@example.com", []string{"user@example.net"}},
+		{"extension", "", false, "", "", "user+tag@example.com", []string{"user@example.net"}},
+		{"full-address-first", "-", false, "", "", "user-tag@example.com", []string{"tagged@example.net"}},
+		{"delimiter", "-", false, "", "", "user-other@example.com", []string{"user@example.net"}},
+		{"recursive", "", false, "", "", "list@example.com", []string{"one@example.org", "two@example.net", "three@example.org"}},
+		{"loop", "", false, "", "", "loop@example.com", []string{"loop@example.com"}},
+		{"parse-error", "", false, "", "", "broken@example.com", []string{"broken@example.com"}},
+		{"query-error", "", false, "unknown", "", "user@example.com", []string{"user@example.com"}},
+		{"catch-all-disabled", "", false, "", "", "nobody@example.org", []string{"nobody@example.org"}},
+		{"catch-all", "", true, "", "", "nobody@example.org", []string{"catch-all@example.net"}},
+		{"catch-all-not-needed", "", true, "", "", "user@example.com", []string{"user@example.net"}},
+		{"catch-all-query", "", true, catchAllQuery, "", "nobody@example.com", []string{"catch-all-query@example.net"}},
+		{"catch-all-key", "", true, "", "%d", "nobody@example.biz", []string{"catch-all-biz@example.net"}},
+		{"catch-all-not-found", "", true, "", "", "nobody@example.net", []string{"nobody@example.net"}},
+		{"catch-all-only-original", "", true, "", "", "alias@example.com", []string{"mailbox@example.org"}},
+		{"row-error", "", true, "", "", "partial@example.org", []string{"partial@example.org"}},
+		{"catch-all-error", "", true, "unknown", "", "nobody@example.net", []string{"nobody@example.net"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Configuration{
+				DbDriver:            "srsmilter-fake",
+				DbDSN:               newFakeDb(t, data),
+				DbForwardQuery:      forwardQuery,
+				RecipientDelimiters: tt.delimiters,
+				ForwardCatchAll:     tt.catchAll,
+				DbCatchAllQuery:     tt.query,
+				CatchAllKey:         tt.key,
+			}
+			if tt.query != "" && !tt.catchAll {
+				c.DbForwardQuery = tt.query
+			}
+			if err := c.Setup(); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range c.ResolveForward(addr.NewRcptTo(tt.email, "", "smtp")) {
+				got = append(got, r.Addr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveForward() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
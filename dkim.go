@@ -0,0 +1,132 @@
+package srsmilter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/d--j/go-milter/mailfilter/header"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimCoverage describes which header fields are covered by the DKIM signatures of a message
+type dkimCoverage struct {
+	// all is true when we could not determine the signed header fields of at least one signature
+	all bool
+	// keys are the canonical keys of all signed header fields
+	keys map[string]bool
+}
+
+// Covers returns true when changing the header field with the canonical key canonicalKey would break a DKIM signature
+func (d dkimCoverage) Covers(canonicalKey string) bool {
+	return d.all || d.keys[canonicalKey]
+}
+
+// Signed returns true when there is at least one DKIM signature
+func (d dkimCoverage) Signed() bool {
+	return d.all || len(d.keys) > 0
+}
+
+// dkimSignedHeaders parses the h= tag of all DKIM-Signature header fields of h.
+// Signatures that we cannot parse are assumed to cover all header fields.
+// The l= tag only limits the signed body length, so it does not change which header fields we can safely modify.
+func dkimSignedHeaders(h header.Header) dkimCoverage {
+	coverage := dkimCoverage{keys: make(map[string]bool)}
+	fields := h.Fields()
+	for fields.Next() {
+		if fields.CanonicalKey() != "Dkim-Signature" || fields.IsDeleted() {
+			continue
+		}
+		keys, ok := parseDkimHeaderTag(fields.UnfoldedValue())
+		if !ok {
+			coverage.all = true
+			continue
+		}
+		for _, k := range keys {
+			coverage.keys[k] = true
+		}
+	}
+	return coverage
+}
+
+// parseDkimHeaderTag returns the canonical keys of the h= tag of the DKIM-Signature value.
+// ok is false when value does not look like a DKIM signature or has no h= tag.
+func parseDkimHeaderTag(value string) (keys []string, ok bool) {
+	hasSignature := false
+	for _, tag := range strings.Split(value, ";") {
+		name, val, found := strings.Cut(tag, "=")
+		if !found {
+			if strings.TrimSpace(tag) != "" {
+				return nil, false
+			}
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "b":
+			hasSignature = true
+		case "h":
+			ok = true
+			for _, k := range strings.Split(val, ":") {
+				k = strings.Join(strings.Fields(k), "")
+				if k != "" {
+					keys = append(keys, textproto.CanonicalMIMEHeaderKey(k))
+				}
+			}
+		}
+	}
+	if !hasSignature || len(keys) == 0 {
+		return nil, false
+	}
+	return keys, ok
+}
+
+// maxDkimVerifications limits the number of DKIM signatures we verify per message
+const maxDkimVerifications = 10
+
+// dkimLookupTimeout limits the time all DNS lookups of DKIM keys of one message may take when DkimLookupTXT is not set
+const dkimLookupTimeout = 10 * time.Second
+
+// dkimResolver looks up the DKIM keys when DkimLookupTXT is not set
+var dkimResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+} = net.DefaultResolver
+
+// verifyDkim verifies the DKIM signatures of the message data and returns which header fields the valid signatures cover.
+// Signatures that fail verification get ignored since there is nothing left that we could break.
+// Signatures that could not be verified because of a temporary error count as valid.
+// When the message cannot be verified at all, fallback gets returned.
+func (c *Configuration) verifyDkim(data io.Reader, fallback dkimCoverage) (dkimCoverage, error) {
+	lookupTXT := c.DkimLookupTXT
+	if lookupTXT == nil {
+		// a slow DNS server must not stall the milter session until the MTA gives up
+		ctx, cancel := context.WithTimeout(context.Background(), dkimLookupTimeout)
+		defer cancel()
+		lookupTXT = func(domain string) ([]string, error) {
+			return dkimResolver.LookupTXT(ctx, domain)
+		}
+	}
+	verifications, err := dkim.VerifyWithOptions(data, &dkim.VerifyOptions{
+		LookupTXT:        lookupTXT,
+		MaxVerifications: maxDkimVerifications,
+	})
+	if err != nil {
+		return fallback, err
+	}
+	coverage := dkimCoverage{keys: make(map[string]bool)}
+	for _, v := range verifications {
+		if v.Err != nil && !dkim.IsTempFail(v.Err) {
+			continue
+		}
+		if len(v.HeaderKeys) == 0 {
+			coverage.all = true
+			continue
+		}
+		for _, k := range v.HeaderKeys {
+			coverage.keys[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(k))] = true
+		}
+	}
+	return coverage, nil
+}
@@ -0,0 +1,178 @@
+package srsmilter
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/d--j/go-milter/mailfilter/testtrx"
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimTestKey is an ed25519 key pair that we publish via dkimTestLookupTXT as sel._domainkey.example.net
+var dkimTestKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{42}, ed25519.SeedSize))
+
+func dkimTestLookupTXT(domain string) ([]string, error) {
+	switch domain {
+	case "sel._domainkey.example.net":
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(dkimTestKey.Public().(ed25519.PublicKey))}, nil
+	case "temp._domainkey.example.net":
+		return nil, &net.DNSError{Err: "timeout", Name: domain, IsTimeout: true, IsTemporary: true}
+	}
+	return nil, errors.New("no such domain")
+}
+
+// dkimSign signs message with dkimTestKey as example.net with the selector sel and covering headerKeys
+func dkimSign(t *testing.T, message string, selector string, headerKeys ...string) string {
+	t.Helper()
+	var b bytes.Buffer
+	err := dkim.Sign(&b, strings.NewReader(message), &dkim.SignOptions{
+		Domain:     "example.net",
+		Selector:   selector,
+		Signer:     dkimTestKey,
+		HeaderKeys: headerKeys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func Test_parseDkimHeaderTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		wantKeys []string
+		wantOk   bool
+	}{
+		{"empty", "", nil, false},
+		{"bogus", "bogus", nil, false},
+		{"no-h", "v=1; a=rsa-sha256; d=example.net; s=sel; b=abc", nil, false},
+		{"no-b", "v=1; a=rsa-sha256; d=example.net; s=sel; h=from:to", nil, false},
+		{"simple", "v=1; a=rsa-sha256; d=example.net; s=sel; h=from:to; bh=abc; b=abc", []string{"From", "To"}, true},
+		{"fws", "v=1; a=rsa-sha256; d=example.net; s=sel;\r\n h=From : Subject :\r\n\tMessage-Id; bh=abc; b=abc", []string{"From", "Subject", "Message-Id"}, true},
+		{"trailing-semicolon", "v=1; h=from; b=abc;", []string{"From"}, true},
+		{"empty-h", "v=1; h=; b=abc", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotKeys, gotOk := parseDkimHeaderTag(tt.value)
+			if !reflect.DeepEqual(gotKeys, tt.wantKeys) {
+				t.Errorf("parseDkimHeaderTag() gotKeys = %v, want %v", gotKeys, tt.wantKeys)
+			}
+			if gotOk != tt.wantOk {
+				t.Errorf("parseDkimHeaderTag() gotOk = %v, want %v", gotOk, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_dkimSignedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    string
+		wantSigned bool
+		covered    []string
+		notCovered []string
+	}{
+		{"unsigned", "Subject: test\r\n\r\n", false, nil, []string{"To", "Cc"}},
+		{"to", "DKIM-Signature: v=1; h=from:to; b=abc\r\nSubject: test\r\n\r\n", true, []string{"From", "To"}, []string{"Cc"}},
+		{"two", "DKIM-Signature: v=1; h=from:to; b=abc\r\nDKIM-Signature: v=1; h=from:cc; b=abc\r\n\r\n", true, []string{"To", "Cc"}, []string{"Bcc"}},
+		{"broken", "DKIM-Signature: v=1; h=from; b=abc\r\nDKIM-Signature: bogus\r\n\r\n", true, []string{"From", "To", "Cc"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trx := (&testtrx.Trx{}).SetHeadersRaw([]byte(tt.headers))
+			got := dkimSignedHeaders(trx.Headers())
+			if got.Signed() != tt.wantSigned {
+				t.Errorf("Signed() = %v, want %v", got.Signed(), tt.wantSigned)
+			}
+			for _, k := range tt.covered {
+				if !got.Covers(k) {
+					t.Errorf("Covers(%q) = false, want true", k)
+				}
+			}
+			for _, k := range tt.notCovered {
+				if got.Covers(k) {
+					t.Errorf("Covers(%q) = true, want false", k)
+				}
+			}
+		})
+	}
+}
+
+func TestConfiguration_verifyDkim(t *testing.T) {
+	message := "From: someone@example.net\r\nTo: someone@example.com\r\nSubject: test\r\n\r\nbody\r\n"
+	fallback := dkimCoverage{all: true}
+	c := &Configuration{DkimLookupTXT: dkimTestLookupTXT}
+	tests := []struct {
+		name       string
+		message    string
+		wantSigned bool
+		covered    []string
+		notCovered []string
+	}{
+		{"valid", dkimSign(t, message, "sel", "From", "To"), true, []string{"From", "To"}, []string{"Cc", "Subject"}},
+		{"unsigned-header-changed", strings.Replace(dkimSign(t, message, "sel", "From", "To"), "Subject: test", "Subject: changed", 1), true, []string{"From", "To"}, []string{"Cc"}},
+		{"tampered-to", strings.Replace(dkimSign(t, message, "sel", "From", "To"), "To: someone@", "To: other@", 1), false, nil, []string{"From", "To"}},
+		{"unknown-key", dkimSign(t, message, "unknown", "From", "To"), false, nil, []string{"From", "To"}},
+		{"temp-fail", dkimSign(t, message, "temp", "From", "To"), true, []string{"From", "To"}, []string{"Cc"}},
+		{"broken", "DKIM-Signature: bogus\r\n" + message, false, nil, []string{"To"}},
+		{"two", dkimSign(t, dkimSign(t, message, "unknown", "From", "Cc"), "sel", "From", "To"), true, []string{"To"}, []string{"Cc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.verifyDkim(strings.NewReader(tt.message), fallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Signed() != tt.wantSigned {
+				t.Errorf("Signed() = %v, want %v", got.Signed(), tt.wantSigned)
+			}
+			for _, k := range tt.covered {
+				if !got.Covers(k) {
+					t.Errorf("Covers(%q) = false, want true", k)
+				}
+			}
+			for _, k := range tt.notCovered {
+				if got.Covers(k) {
+					t.Errorf("Covers(%q) = true, want false", k)
+				}
+			}
+		})
+	}
+	if got, err := c.verifyDkim(strings.NewReader("broken header"), fallback); err == nil || !reflect.DeepEqual(got, fallback) {
+		t.Errorf("verifyDkim() = %v, %v, want fallback and error", got, err)
+	}
+}
+
+// dkimTestResolver only answers lookups that have a deadline
+type dkimTestResolver struct{}
+
+func (dkimTestResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("lookup without deadline")
+	}
+	return dkimTestLookupTXT(name)
+}
+
+func TestConfiguration_verifyDkim_defaultLookup(t *testing.T) {
+	orig := dkimResolver
+	dkimResolver = dkimTestResolver{}
+	t.Cleanup(func() { dkimResolver = orig })
+	c := &Configuration{}
+	message := dkimSign(t, "From: someone@example.net\r\nTo: someone@example.com\r\n\r\nbody\r\n", "sel", "From", "To")
+	got, err := c.verifyDkim(strings.NewReader(message), dkimCoverage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Covers("To") {
+		t.Errorf("Covers(%q) = false, want true", "To")
+	}
+}
@@ -0,0 +1,233 @@
+package srsmilter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// ParseDomain converts domain to its ASCII representation.
+// The wildcard prefixes "*." and "." and regular expressions (enclosed in slashes) that you can use in
+// LocalDomains are kept as-is.
+func ParseDomain(domain string) (Domain, error) {
+	if isDomainRegexp(domain) {
+		return Domain(domain), nil
+	}
+	prefix, rest := splitDomainWildcard(domain)
+	ascii, err := idna.Lookup.ToASCII(rest)
+	if err != nil {
+		return Domain(domain), err
+	}
+	return Domain(prefix + ascii), nil
+}
+
+func isDomainRegexp(domain string) bool {
+	return len(domain) > 2 && domain[0] == '/' && domain[len(domain)-1] == '/'
+}
+
+func splitDomainWildcard(domain string) (prefix, rest string) {
+	if strings.HasPrefix(domain, "*.") {
+		return "*.", domain[2:]
+	}
+	if strings.HasPrefix(domain, ".") {
+		return ".", domain[1:]
+	}
+	return "", domain
+}
+
+// domainMatcher matches ASCII domains against a list of exact domains, parent domains and regular expressions.
+// Exact and parent domain matches only need map lookups.
+type domainMatcher struct {
+	exact   map[string]bool
+	parents map[string]bool
+	regexps []*regexp.Regexp
+	// matchSubdomains makes plain entries also match their subdomains (like Postfix' parent_domain_matches_subdomains)
+	matchSubdomains bool
+}
+
+func newDomainMatcher(matchSubdomains bool) *domainMatcher {
+	return &domainMatcher{
+		exact:           make(map[string]bool),
+		parents:         make(map[string]bool),
+		matchSubdomains: matchSubdomains,
+	}
+}
+
+// Add adds d to the list of matched domains.
+// "*.example.com" and ".example.com" match all subdomains of example.com (but not example.com itself).
+// "/regexp/" matches all domains the case-insensitive regular expression regexp matches.
+func (m *domainMatcher) Add(d Domain) error {
+	s := d.String()
+	if isDomainRegexp(s) {
+		re, err := regexp.Compile("(?i)" + s[1:len(s)-1])
+		if err != nil {
+			return fmt.Errorf("invalid domain regexp %s: %w", s, err)
+		}
+		m.regexps = append(m.regexps, re)
+		return nil
+	}
+	prefix, rest := splitDomainWildcard(strings.ToLower(s))
+	if rest == "" {
+		return nil
+	}
+	if prefix != "" {
+		m.parents[rest] = true
+		return nil
+	}
+	m.exact[rest] = true
+	if m.matchSubdomains {
+		m.parents[rest] = true
+	}
+	return nil
+}
+
+// Match returns true when asciiDomain matches any of the entries of m
+func (m *domainMatcher) Match(asciiDomain string) bool {
+	if asciiDomain == "" {
+		return false
+	}
+	if m.exact[asciiDomain] {
+		return true
+	}
+	if len(m.parents) > 0 {
+		for rest := asciiDomain; ; {
+			dot := strings.IndexByte(rest, '.')
+			if dot < 0 {
+				break
+			}
+			rest = rest[dot+1:]
+			if m.parents[rest] {
+				return true
+			}
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(asciiDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultLocalDomainsRefresh is used when LocalDomainsRefresh is not set
+const defaultLocalDomainsRefresh = 5 * time.Minute
+
+// hasDynamicLocalDomains returns true when LocalDomainsQuery or LocalDomainsFile is configured
+func (c *Configuration) hasDynamicLocalDomains() bool {
+	return (c.db != nil && c.LocalDomainsQuery != "") || c.LocalDomainsFile != ""
+}
+
+// loadDynamicLocalDomains reads LocalDomainsQuery and LocalDomainsFile into a new domainMatcher
+func (c *Configuration) loadDynamicLocalDomains() (*domainMatcher, int, error) {
+	m := newDomainMatcher(c.LocalDomainsMatchSubdomains)
+	count := 0
+	if c.db != nil && c.LocalDomainsQuery != "" {
+		n, err := c.queryLocalDomains(m)
+		if err != nil {
+			return nil, 0, err
+		}
+		count += n
+	}
+	if c.LocalDomainsFile != "" {
+		n, err := readLocalDomainsFile(c.LocalDomainsFile, m)
+		if err != nil {
+			return nil, 0, err
+		}
+		count += n
+	}
+	return m, count, nil
+}
+
+func (c *Configuration) queryLocalDomains(m *domainMatcher) (int, error) {
+	rows, err := c.db.Query(c.LocalDomainsQuery)
+	if err != nil {
+		return 0, fmt.Errorf("query error looking up local domains: %w", err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		domain := ""
+		if err = rows.Scan(&domain); err != nil {
+			return 0, fmt.Errorf("scan error looking up local domains: %w", err)
+		}
+		if addDynamicLocalDomain(m, domain, "query") {
+			count++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("query error looking up local domains: %w", err)
+	}
+	return count, nil
+}
+
+// readLocalDomainsFile reads a Postfix lookup table source file (e.g. the one of virtual_mailbox_domains).
+// The first field of each line is the domain, the rest of the line and comment lines get ignored.
+func readLocalDomainsFile(path string, m *domainMatcher) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if addDynamicLocalDomain(m, strings.Fields(line)[0], path) {
+			count++
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func addDynamicLocalDomain(m *domainMatcher, domain, source string) bool {
+	domain = strings.TrimSpace(domain)
+	if domain == "" {
+		return false
+	}
+	d, err := ParseDomain(domain)
+	if err != nil {
+		Log.Warn("skipping invalid local domain", "sub", "domains", "source", source, "domain", domain, "err", err)
+		return false
+	}
+	if err = m.Add(d); err != nil {
+		Log.Warn("skipping invalid local domain", "sub", "domains", "source", source, "domain", domain, "err", err)
+		return false
+	}
+	return true
+}
+
+// refreshDynamicLocalDomains reloads the dynamic local domains every LocalDomainsRefresh until done gets closed.
+// When reloading fails, we keep using the old list.
+func (c *Configuration) refreshDynamicLocalDomains(done <-chan struct{}) {
+	interval := c.LocalDomainsRefresh
+	if interval <= 0 {
+		interval = defaultLocalDomainsRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			m, count, err := c.loadDynamicLocalDomains()
+			if err != nil {
+				Log.Warn("could not refresh local domains, keeping old list", "sub", "domains", "err", err)
+				continue
+			}
+			c.dynamicLocalDomains.Store(m)
+			Log.Debug("refreshed local domains", "sub", "domains", "count", count)
+		}
+	}
+}
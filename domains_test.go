@@ -0,0 +1,185 @@
+package srsmilter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Domain
+		wantErr bool
+	}{
+		{"simple", "example.com", "example.com", false},
+		{"upper", "Example.COM", "example.com", false},
+		{"idna", "näkkileipä.example.com", "xn--nkkileip-0zah.example.com", false},
+		{"star", "*.näkkileipä.example.com", "*.xn--nkkileip-0zah.example.com", false},
+		{"dot", ".näkkileipä.example.com", ".xn--nkkileip-0zah.example.com", false},
+		{"regexp", "/^customer[0-9]+\\.example\\.com$/", "/^customer[0-9]+\\.example\\.com$/", false},
+		{"bogus", "bogus*domain", "bogus*domain", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDomain(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseDomain() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseDomain() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_domainMatcher_Match(t *testing.T) {
+	entries := toDomainSlice([]string{"example.com", "*.example.net", ".example.org", "/^customer[0-9]+\\.example\\.biz$/", "näkkileipä.example"})
+	tests := []struct {
+		name            string
+		matchSubdomains bool
+		arg             string
+		want            bool
+	}{
+		{"empty", false, "", false},
+		{"exact", false, "example.com", true},
+		{"exact-subdomain", false, "sub.example.com", false},
+		{"exact-subdomain-parent", true, "sub.example.com", true},
+		{"exact-deep-subdomain-parent", true, "deep.sub.example.com", true},
+		{"exact-other-parent", true, "notexample.com", false},
+		{"star", false, "sub.example.net", true},
+		{"star-deep", false, "deep.sub.example.net", true},
+		{"star-itself", false, "example.net", false},
+		{"star-other", false, "notexample.net", false},
+		{"dot", false, "sub.example.org", true},
+		{"dot-itself", false, "example.org", false},
+		{"regexp", false, "customer42.example.biz", true},
+		{"regexp-case", false, "Customer42.example.biz", true},
+		{"regexp-no-match", false, "customer.example.biz", false},
+		{"idna", false, "xn--nkkileip-0zah.example", true},
+		{"other", true, "example.invalid", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newDomainMatcher(tt.matchSubdomains)
+			for _, d := range entries {
+				if err := m.Add(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := m.Match(tt.arg); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_domainMatcher_Add(t *testing.T) {
+	m := newDomainMatcher(false)
+	if err := m.Add("/(broken/"); err == nil {
+		t.Errorf("Add() expected error for broken regexp")
+	}
+	if err := m.Add(""); err != nil {
+		t.Errorf("Add() unexpected error %v", err)
+	}
+	if m.Match("") {
+		t.Errorf("Match() matched empty domain")
+	}
+}
+
+func writeLocalDomainsFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfiguration_DynamicLocalDomains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "virtual_domains")
+	writeLocalDomainsFile(t, path, "# comment\n\nfile.example   OK\n  *.sub.file.example\nbogus*domain x\n")
+	c := Configuration{
+		LocalDomains:      toDomainSlice([]string{"static.example"}),
+		DbDriver:          "srsmilter-fake",
+		DbDSN:             newFakeDb(t, map[string]map[string][]string{"domains": {"": {"db.example", "Näkkileipä.example", ""}}}),
+		LocalDomainsQuery: "domains",
+		LocalDomainsFile:  path,
+	}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	for domain, want := range map[string]bool{
+		"static.example":            true,
+		"db.example":                true,
+		"xn--nkkileip-0zah.example": true,
+		"file.example":              true,
+		"a.sub.file.example":        true,
+		"sub.file.example":          false,
+		"bogus*domain":              false,
+		"other.example":             false,
+	} {
+		if got := c.IsLocalDomain(domain); got != want {
+			t.Errorf("IsLocalDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestConfiguration_DynamicLocalDomainsRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "virtual_domains")
+	writeLocalDomainsFile(t, path, "old.example\n")
+	c := Configuration{
+		LocalDomainsFile:    path,
+		LocalDomainsRefresh: 10 * time.Millisecond,
+	}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if !c.IsLocalDomain("old.example") {
+		t.Fatalf("old.example not local")
+	}
+	writeLocalDomainsFile(t, path, "new.example\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.IsLocalDomain("new.example") {
+		if time.Now().After(deadline) {
+			t.Fatalf("new.example did not get loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.IsLocalDomain("old.example") {
+		t.Errorf("old.example is still local")
+	}
+	// a broken source keeps the old list
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !c.IsLocalDomain("new.example") {
+		t.Errorf("new.example got removed")
+	}
+}
+
+func TestConfiguration_DynamicLocalDomainsErrors(t *testing.T) {
+	c := Configuration{LocalDomainsFile: filepath.Join(t.TempDir(), "does-not-exist")}
+	if err := c.Setup(); err == nil {
+		t.Errorf("Setup() expected error for missing file")
+	}
+	dsn := newFakeDb(t, map[string]map[string][]string{})
+	c = Configuration{
+		DbDriver:          "srsmilter-fake",
+		DbDSN:             dsn,
+		LocalDomainsQuery: "unknown",
+	}
+	if err := c.Setup(); err == nil {
+		t.Errorf("Setup() expected error for broken query")
+	}
+	db := fakeDbs[dsn]
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.conns != 0 {
+		t.Errorf("open connections after failed Setup() = %d, want 0", db.conns)
+	}
+}
@@ -0,0 +1,83 @@
+package srsmilter
+
+import (
+	"io"
+
+	"github.com/d--j/go-milter/mailfilter"
+	"github.com/d--j/go-milter/mailfilter/addr"
+)
+
+// IsDryRun returns true when Filter should not modify the message of trx: either DryRun is set or
+// the envelope sender or any envelope recipient matches DryRunDomains.
+func (c *Configuration) IsDryRun(trx mailfilter.Trx) bool {
+	return c.isDryRunEnvelope(trx.MailFrom(), trx.RcptTos())
+}
+
+// isDryRunEnvelope is IsDryRun for the envelope sender from and the envelope recipients tos
+func (c *Configuration) isDryRunEnvelope(from *addr.MailFrom, tos []*addr.RcptTo) bool {
+	if c.DryRun {
+		return true
+	}
+	if c.dryRunDomains == nil {
+		return false
+	}
+	if from.Addr != "" && c.dryRunDomains.Match(from.AsciiDomain()) {
+		return true
+	}
+	for _, to := range tos {
+		if c.dryRunDomains.Match(to.AsciiDomain()) {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunTrx applies the envelope changes of Filter to a copy of the recipients, so that later checks of Filter see
+// the same recipients as without dry-run. It never passes envelope or body changes to the MTA.
+type dryRunTrx struct {
+	mailfilter.Trx
+	rcptTos []*addr.RcptTo
+}
+
+func newDryRunTrx(trx mailfilter.Trx) *dryRunTrx {
+	t := &dryRunTrx{Trx: trx}
+	for _, to := range trx.RcptTos() {
+		t.rcptTos = append(t.rcptTos, to.Copy())
+	}
+	return t
+}
+
+func (t *dryRunTrx) ChangeMailFrom(_ string, _ string) {}
+
+func (t *dryRunTrx) RcptTos() []*addr.RcptTo {
+	return t.rcptTos
+}
+
+func (t *dryRunTrx) HasRcptTo(rcptTo string) bool {
+	return t.index(rcptTo) >= 0
+}
+
+func (t *dryRunTrx) AddRcptTo(rcptTo string, esmtpArgs string) {
+	if t.index(rcptTo) < 0 {
+		t.rcptTos = append(t.rcptTos, addr.NewRcptTo(rcptTo, esmtpArgs, "new"))
+	}
+}
+
+func (t *dryRunTrx) DelRcptTo(rcptTo string) {
+	if i := t.index(rcptTo); i >= 0 {
+		t.rcptTos = append(t.rcptTos[:i], t.rcptTos[i+1:]...)
+	}
+}
+
+func (t *dryRunTrx) ReplaceBody(_ io.Reader) {}
+
+// index returns the index of rcptTo in the recipients or -1 (using the same comparison as go-milter)
+func (t *dryRunTrx) index(rcptTo string) int {
+	find := addr.NewRcptTo(rcptTo, "", "")
+	for i, r := range t.rcptTos {
+		if r.Local() == find.Local() && r.AsciiDomain() == find.AsciiDomain() {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,138 @@
+package srsmilter
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/d--j/go-milter/mailfilter"
+	"github.com/d--j/go-milter/mailfilter/addr"
+	"github.com/d--j/go-milter/mailfilter/testtrx"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// rewriteMetrics returns the sum of all forward and reverse rewrite counters with the dry_run label dryRun
+func rewriteMetrics(dryRun bool) float64 {
+	label := strconv.FormatBool(dryRun)
+	sum := 0.0
+	for _, reason := range []string{ReasonSpf, ReasonRecipientPolicy, ReasonSenderPolicy} {
+		sum += testutil.ToFloat64(metricForwardRewrites.WithLabelValues(reason, label))
+	}
+	for _, kind := range []string{"envelope", "header", "dsn"} {
+		sum += testutil.ToFloat64(metricReverseRewrites.WithLabelValues(kind, label))
+	}
+	return sum
+}
+
+func TestConfiguration_IsDryRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  bool
+		domains []string
+		from    string
+		tos     []string
+		want    bool
+	}{
+		{"off", false, nil, "someone@example.net", []string{"remote@example.org"}, false},
+		{"global", true, nil, "someone@example.net", []string{"remote@example.org"}, true},
+		{"sender-domain", false, []string{"example.net"}, "someone@example.net", []string{"remote@example.org"}, true},
+		{"recipient-domain", false, []string{"example.org"}, "someone@example.net", []string{"local@example.com", "remote@example.org"}, true},
+		{"wildcard", false, []string{"*.example.org"}, "someone@example.net", []string{"remote@mx.example.org"}, true},
+		{"other-domain", false, []string{"example.biz"}, "someone@example.net", []string{"remote@example.org"}, false},
+		{"null-sender", false, []string{"example.org"}, "", []string{"SRS0=PNjA=46=example.net=my-srs@srs.example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Configuration{SrsDomain: "srs.example.com", DryRun: tt.global, DryRunDomains: toDomainSlice(tt.domains)}
+			if err := c.Setup(); err != nil {
+				t.Fatal(err)
+			}
+			trx := (&testtrx.Trx{}).
+				SetMailFrom(addr.NewMailFrom(tt.from, "", "smtp", "", "")).
+				SetRcptTosList(tt.tos...)
+			if got := c.IsDryRun(trx); got != tt.want {
+				t.Errorf("IsDryRun() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter_dryRun(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	newTrx := func(from, headers string, tos ...string) *testtrx.Trx {
+		return (&testtrx.Trx{}).
+			SetQueueId("Q1").
+			SetMTA(mailfilter.MTA{FQDN: "mx.example.com"}).
+			SetConnect(mailfilter.Connect{Family: "tcp4", Addr: "192.0.2.1"}).
+			SetMailFrom(addr.NewMailFrom(from, "", "smtp", "", "")).
+			SetRcptTosList(tos...).
+			SetHeadersRaw([]byte(headers + "Subject: test\r\n\r\n")).
+			SetBodyBytes([]byte("body\r\n"))
+	}
+	tests := []struct {
+		name        string
+		domains     []string
+		trx         *testtrx.Trx
+		wantActions []string
+		wantMods    []testtrx.Modification
+	}{
+		{"sender", nil, newTrx("someone@example.net", "", "remote@example.org"), []string{AuditSender}, nil},
+		{"reverse", nil, newTrx("", "To: SRS0=PNjA=46=example.net=my-srs@srs.example.com\r\n", "SRS0=PNjA=46=example.net=my-srs@srs.example.com"), []string{AuditRecipientEnv, AuditRecipientHdr}, nil},
+		{"bounce-mode-reject", nil, newTrx("someone@example.org", "", "SRS0=PNjA=46=example.net=my-srs@srs.example.com"), nil, nil},
+		{"bounce-mode-reject-mixed", nil, newTrx("someone@example.com", "", "local@example.com", "SRS0=PNjA=46=example.net=my-srs@srs.example.com"), nil, nil},
+		{"strip-header", nil, newTrx("someone@example.com", "X-SRS-Original-Sender: <forged@example.com>\r\n", "local@example.com"), nil, nil},
+		{"split", nil, newTrx("someone@example.net", "", "local@example.com", "remote@example.org"), []string{AuditSplit}, nil},
+		{"domain-matches", []string{"example.org"}, newTrx("someone@example.net", "", "remote@example.org"), []string{AuditSender}, nil},
+		{"domain-does-not-match", []string{"example.biz"}, newTrx("someone@example.net", "", "remote@example.org"), []string{AuditSender}, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=R9Ph=46=example.net=someone@srs.example.com"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			conf := testConfig(t, &Configuration{
+				BounceMode:           true,
+				StripHeaders:         []string{"X-SRS-Original-Sender"},
+				SplitMixedRecipients: true,
+				// nothing listens here – we must not connect in dry-run mode
+				SplitRelayAddr: "127.0.0.1:1",
+				AuditLog:       path,
+				DryRun:         tt.domains == nil,
+				DryRunDomains:  toDomainSlice(tt.domains),
+			})
+			dryRun := tt.wantMods == nil
+			before, beforeOther := rewriteMetrics(dryRun), rewriteMetrics(!dryRun)
+			decision, err := Filter(context.Background(), tt.trx, conf, NewCache(conf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rewriteMetrics(dryRun) - before; got != float64(len(tt.wantActions)) {
+				t.Errorf("rewrite metrics with dry_run=%v got = %v, want %v", dryRun, got, len(tt.wantActions))
+			}
+			if got := rewriteMetrics(!dryRun) - beforeOther; got != 0 {
+				t.Errorf("rewrite metrics with dry_run=%v got = %v, want 0", !dryRun, got)
+			}
+			if decision != mailfilter.Accept {
+				t.Errorf("Filter() decision = %v, want %v", decision, mailfilter.Accept)
+			}
+			if err := conf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.trx.Modifications(), tt.wantMods) {
+				t.Errorf("trx.Modifications() got = %v, want %v", tt.trx.Modifications(), tt.wantMods)
+			}
+			var actions []string
+			if len(tt.wantActions) > 0 {
+				for _, r := range readAuditLog(t, path) {
+					actions = append(actions, r.Action)
+					if r.DryRun != (tt.wantMods == nil) {
+						t.Errorf("audit record DryRun = %v, want %v", r.DryRun, tt.wantMods == nil)
+					}
+				}
+			}
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("audit actions got = %v, want %v", actions, tt.wantActions)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package srsmilter
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// srsAddressRegexp matches anything that looks like an SRS address in a DSN part
+var srsAddressRegexp = regexp.MustCompile(`(?i)\bsrs[01]=[^\s<>()\[\];,"@]+@[a-z0-9.-]+`)
+
+// isDsnPart returns true when the DSN part with the media type mediaType contains addresses we reverse SRS
+func isDsnPart(mediaType string) (isDsn bool, headersOnly bool) {
+	switch mediaType {
+	case "message/delivery-status", "message/global-delivery-status", "message/rfc822-headers", "text/rfc822-headers", "message/global-headers":
+		return true, false
+	case "message/rfc822", "message/global":
+		// only touch the header of the returned message
+		return true, true
+	}
+	return false, false
+}
+
+// dsnRewrite is one SRS address that reverseDsn replaced
+type dsnRewrite struct {
+	From     string
+	To       string
+	KeyIndex int // index of the SRS key that validated From
+}
+
+func (r dsnRewrite) String() string {
+	return r.From + ":" + r.To
+}
+
+// reverseDsn reverse SRS rewrites our SRS addresses in the parts of a DSN (a multipart/report message with the
+// Content-Type contentType and the body body) that describe the delivery status or contain the returned header.
+// It returns nil when the message is not a DSN or when there was nothing to change.
+// We keep the preamble and the epilogue of the DSN but write the boundary delimiters in canonical form.
+// Parts that use a Content-Transfer-Encoding other than 7bit, 8bit or binary are left alone.
+func (c *Configuration) reverseDsn(contentType string, body io.Reader) (newBody []byte, rewrites []dsnRewrite, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, nil, nil
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	preamble, epilogue := multipartFrame(raw, params["boundary"])
+	buf := bytes.Buffer{}
+	buf.Write(preamble)
+	w := textproto.NewMultipartWriter(&buf)
+	if err = w.SetBoundary(params["boundary"]); err != nil {
+		return nil, nil, err
+	}
+	r := textproto.NewMultipartReader(bytes.NewReader(raw), params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if isDsn, headersOnly := isDsnPart(strings.ToLower(partType)); isDsn && isIdentityEncoding(p.Header.Get("Content-Transfer-Encoding")) {
+			var partRewrites []dsnRewrite
+			if headersOnly {
+				data, partRewrites = c.reverseSrsInMessageHeader(data)
+			} else {
+				data, partRewrites = c.reverseSrsInText(data)
+			}
+			rewrites = append(rewrites, partRewrites...)
+		}
+		pw, err := w.CreatePart(p.Header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err = pw.Write(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(rewrites) == 0 {
+		return nil, nil, nil
+	}
+	if err = w.Close(); err != nil {
+		return nil, nil, err
+	}
+	buf.Write(epilogue)
+	return buf.Bytes(), rewrites, nil
+}
+
+// multipartFrame returns the bytes before the first boundary delimiter line and after the close delimiter line
+// of the multipart body with the boundary boundary
+func multipartFrame(body []byte, boundary string) (preamble, epilogue []byte) {
+	delimiter := []byte("--" + boundary)
+	start := 0
+	if !bytes.HasPrefix(body, delimiter) {
+		i := bytes.Index(body, append([]byte("\n"), delimiter...))
+		if i < 0 {
+			return nil, nil
+		}
+		start = i + 1
+	}
+	closeDelimiter := append([]byte("\n"), delimiter...)
+	closeDelimiter = append(closeDelimiter, '-', '-')
+	end := bytes.Index(body[start:], closeDelimiter)
+	if end < 0 {
+		return body[:start], nil
+	}
+	rest := body[start+end+len(closeDelimiter):]
+	if nl := bytes.IndexByte(rest, '\n'); nl >= 0 {
+		epilogue = rest[nl+1:]
+	}
+	return body[:start], epilogue
+}
+
+func isIdentityEncoding(encoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return true
+	}
+	return false
+}
+
+// reverseSrsInMessageHeader reverse SRS rewrites the header section of the message data and leaves its body alone
+func (c *Configuration) reverseSrsInMessageHeader(data []byte) ([]byte, []dsnRewrite) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = bytes.Index(data, []byte("\n\n"))
+	}
+	if end < 0 {
+		return c.reverseSrsInText(data)
+	}
+	header, rewrites := c.reverseSrsInText(data[:end])
+	if len(rewrites) == 0 {
+		return data, nil
+	}
+	return append(header, data[end:]...), rewrites
+}
+
+// reverseSrsInText replaces all of our SRS addresses in data with their reverse SRS addresses
+func (c *Configuration) reverseSrsInText(data []byte) ([]byte, []dsnRewrite) {
+	var rewrites []dsnRewrite
+	out := srsAddressRegexp.ReplaceAllFunc(data, func(match []byte) []byte {
+		a := strings.TrimRight(string(match), ".")
+		at := strings.LastIndexByte(a, '@')
+		if !strings.EqualFold(a[at+1:], c.SrsDomain.String()) {
+			return match
+		}
+		rewritten, keyIndex, err := reverseSrs(a, c)
+		if err != nil {
+			Log.Debug("could not reverse SRS address in DSN", "sub", "milter", "addr", a, "err", err)
+			return match
+		}
+		rewrites = append(rewrites, dsnRewrite{From: a, To: rewritten, KeyIndex: keyIndex})
+		return append([]byte(rewritten), match[len(a):]...)
+	})
+	return out, rewrites
+}
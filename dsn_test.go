@@ -0,0 +1,177 @@
+package srsmilter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDsnContentType = `multipart/report; report-type=delivery-status; boundary="B0UND"`
+
+func testDsn(deliveryStatus, returned string) string {
+	return strings.ReplaceAll("This is a MIME-encapsulated message.\n"+
+		"\n"+
+		"--B0UND\n"+
+		"Content-Type: text/plain; charset=us-ascii\n"+
+		"\n"+
+		"Your message to <SRS0=PNjA=46=example.net=my-srs@srs.example.com> could not be delivered.\n"+
+		"\n"+
+		"--B0UND\n"+
+		"Content-Type: message/delivery-status\n"+
+		"\n"+
+		deliveryStatus+
+		"\n"+
+		"--B0UND\n"+
+		returned+
+		"\n"+
+		"--B0UND--\n", "\n", "\r\n")
+}
+
+func TestConfiguration_reverseDsn(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	c := testConfig(t, &Configuration{})
+	status := "Reporting-MTA: dns; mx.example.org\n" +
+		"\n" +
+		"Final-Recipient: rfc822; SRS0=PNjA=46=example.net=my-srs@srs.example.com\n" +
+		"Original-Recipient: rfc822;srs0=PNjA=46=example.net=my-srs@SRS.example.com\n" +
+		"Action: failed\n" +
+		"Status: 5.1.1\n"
+	headers := "Content-Type: text/rfc822-headers\n" +
+		"\n" +
+		"Return-Path: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\n" +
+		"To: other@srs.example.com.example\n"
+	message := "Content-Type: message/rfc822\n" +
+		"\n" +
+		"Return-Path: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\n" +
+		"Subject: test\n" +
+		"\n" +
+		"Please reply to SRS0=PNjA=46=example.net=my-srs@srs.example.com.\n"
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		want         string
+		wantRewrites []dsnRewrite
+		wantErr      bool
+	}{
+		{"not-a-report", "multipart/mixed; boundary=B0UND", testDsn(status, headers), "", nil, false},
+		{"no-boundary", "multipart/report", testDsn(status, headers), "", nil, false},
+		{"nothing-to-do", testDsnContentType, testDsn("Final-Recipient: rfc822; someone@example.org\n", "Content-Type: text/rfc822-headers\n\nReturn-Path: <someone@example.net>\n"), "", nil, false},
+		{"returned-headers", testDsnContentType, testDsn("Final-Recipient: rfc822; someone@example.org\n", headers), strings.ReplaceAll("This is a MIME-encapsulated message.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/plain; charset=us-ascii\n"+
+			"\n"+
+			"Your message to <SRS0=PNjA=46=example.net=my-srs@srs.example.com> could not be delivered.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: message/delivery-status\n"+
+			"\n"+
+			"Final-Recipient: rfc822; someone@example.org\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/rfc822-headers\n"+
+			"\n"+
+			"Return-Path: <my-srs@example.net>\n"+
+			"To: other@srs.example.com.example\n"+
+			"\n"+
+			"--B0UND--\n", "\n", "\r\n"), []dsnRewrite{{"SRS0=PNjA=46=example.net=my-srs@srs.example.com", "my-srs@example.net", 0}}, false},
+		{"status", testDsnContentType, testDsn(status, "Content-Type: text/plain\n\nSRS0=PNjA=46=example.net=my-srs@srs.example.com\n"), strings.ReplaceAll("This is a MIME-encapsulated message.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/plain; charset=us-ascii\n"+
+			"\n"+
+			"Your message to <SRS0=PNjA=46=example.net=my-srs@srs.example.com> could not be delivered.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: message/delivery-status\n"+
+			"\n"+
+			"Reporting-MTA: dns; mx.example.org\n"+
+			"\n"+
+			"Final-Recipient: rfc822; my-srs@example.net\n"+
+			"Original-Recipient: rfc822;my-srs@example.net\n"+
+			"Action: failed\n"+
+			"Status: 5.1.1\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/plain\n"+
+			"\n"+
+			"SRS0=PNjA=46=example.net=my-srs@srs.example.com\n"+
+			"\n"+
+			"--B0UND--\n", "\n", "\r\n"), []dsnRewrite{
+			{"SRS0=PNjA=46=example.net=my-srs@srs.example.com", "my-srs@example.net", 0},
+			{"srs0=PNjA=46=example.net=my-srs@SRS.example.com", "my-srs@example.net", 0},
+		}, false},
+		{"message", testDsnContentType, testDsn("Final-Recipient: rfc822; someone@example.org\n", message), strings.ReplaceAll("This is a MIME-encapsulated message.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/plain; charset=us-ascii\n"+
+			"\n"+
+			"Your message to <SRS0=PNjA=46=example.net=my-srs@srs.example.com> could not be delivered.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: message/delivery-status\n"+
+			"\n"+
+			"Final-Recipient: rfc822; someone@example.org\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: message/rfc822\n"+
+			"\n"+
+			"Return-Path: <my-srs@example.net>\n"+
+			"Subject: test\n"+
+			"\n"+
+			"Please reply to SRS0=PNjA=46=example.net=my-srs@srs.example.com.\n"+
+			"\n"+
+			"--B0UND--\n", "\n", "\r\n"), []dsnRewrite{{"SRS0=PNjA=46=example.net=my-srs@srs.example.com", "my-srs@example.net", 0}}, false},
+		{"epilogue", testDsnContentType, testDsn("Final-Recipient: rfc822; SRS0=PNjA=46=example.net=my-srs@srs.example.com\n", "Content-Type: text/plain\n\ntext\n") + "This is the epilogue.\r\n", strings.ReplaceAll("This is a MIME-encapsulated message.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/plain; charset=us-ascii\n"+
+			"\n"+
+			"Your message to <SRS0=PNjA=46=example.net=my-srs@srs.example.com> could not be delivered.\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: message/delivery-status\n"+
+			"\n"+
+			"Final-Recipient: rfc822; my-srs@example.net\n"+
+			"\n"+
+			"--B0UND\n"+
+			"Content-Type: text/plain\n"+
+			"\n"+
+			"text\n"+
+			"\n"+
+			"--B0UND--\n"+
+			"This is the epilogue.\n", "\n", "\r\n"), []dsnRewrite{{"SRS0=PNjA=46=example.net=my-srs@srs.example.com", "my-srs@example.net", 0}}, false},
+		{"encoded", testDsnContentType, testDsn("Final-Recipient: rfc822; someone@example.org\n", "Content-Type: text/rfc822-headers\nContent-Transfer-Encoding: quoted-printable\n\nReturn-Path: <SRS0=3DPNjA=3D46=3Dexample.net=3Dmy-srs@srs.example.com>\n"), "", nil, false},
+		{"broken", testDsnContentType, "--B0UND\r\nContent-Type: message/delivery-status\r\n\r\nFinal-Recipient: rfc822; SRS0=PNjA=46=example.net=my-srs@srs.example.com\r\n", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rewrites, err := c.reverseDsn(tt.contentType, strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reverseDsn() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("reverseDsn() got = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(rewrites, tt.wantRewrites) {
+				t.Errorf("reverseDsn() rewrites = %v, want %v", rewrites, tt.wantRewrites)
+			}
+		})
+	}
+	t.Run("rotated-key", func(t *testing.T) {
+		rotated := testConfig(t, &Configuration{SrsKeys: []string{"new-key", "secret-key"}})
+		_, rewrites, err := rotated.reverseDsn(testDsnContentType, strings.NewReader(testDsn(status, headers)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rewrites {
+			if r.KeyIndex != 1 {
+				t.Errorf("reverseDsn() rewrite %v KeyIndex = %d, want 1", r, r.KeyIndex)
+			}
+		}
+		if len(rewrites) == 0 {
+			t.Errorf("reverseDsn() got no rewrites")
+		}
+	})
+}
@@ -1,10 +1,14 @@
 package srsmilter
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/d--j/go-milter/mailfilter"
 	"github.com/d--j/go-milter/mailfilter/addr"
@@ -15,11 +19,73 @@ func Filter(_ context.Context, trx mailfilter.Trx, config *Configuration, cache
 	startTime := time.Now()
 	fromIsSrs := trx.MailFrom().AsciiDomain() == config.SrsDomain.String() && looksLikeSrs(trx.MailFrom().Local())
 	hasRemoteTo := false
-	hasDkim := trx.Headers().Value("Dkim-Signature") != ""
+	hasLocalTo := false
+	remoteTos := []string(nil)
+	forceRewrite := false
+	splitFrom := ""
+	reason := ""
+	spfResult := ""
+	dkim := dkimSignedHeaders(trx.Headers())
 	actions := []string(nil)
+	dryRun := config.IsDryRun(trx)
+	dryRunLabel := strconv.FormatBool(dryRun)
+	addTrace := config.TraceHeader != "" && !(dkim.Signed() && config.TraceHeaderUnlessDkim) && !dryRun
 
 	logger := Log.New("sub", "milter", "qid", trx.QueueId(), "user", trx.MailFrom().AuthenticatedUser())
+	// in dry-run mode we do everything as usual but do not pass our modifications to the MTA
+	if dryRun {
+		trx = newDryRunTrx(trx)
+		logger = logger.New("dryRun", true)
+	}
+	audit := func(r AuditRecord) {
+		r.DryRun = dryRun
+		config.audit(r)
+	}
 	logger.Debug("start", "ofrom", trx.MailFrom().Addr)
+	metricMessages.Inc()
+
+	// only valid DKIM signatures prevent us from changing header fields
+	if config.VerifyDkim && dkim.Signed() && trx.Body() != nil {
+		var err error
+		if dkim, err = config.verifyDkim(trx.Data(), dkim); err != nil {
+			logger.Warn("could not verify DKIM signatures", "err", err)
+		}
+	}
+
+	// remove our own header fields from untrusted messages – they might be forged
+	if len(config.stripHeaders) > 0 && !config.IsTrustedConnection(trx) {
+		fields := trx.Headers().Fields()
+		for fields.Next() {
+			if config.stripHeaders[fields.CanonicalKey()] && !fields.IsDeleted() {
+				logger.Debug("removing header from untrusted message", "key", fields.Key(), "value", fields.Value(), "addr", trx.Connect().Addr)
+				actions = append(actions, fmt.Sprintf("strip_hdr:%s", fields.CanonicalKey()))
+				if !dryRun {
+					fields.Del()
+				}
+			}
+		}
+	}
+
+	// our SRS addresses only receive bounces – everything else is almost always spam
+	isBounce := config.IsBounceSender(trx.MailFrom())
+	if config.BounceMode && !isBounce {
+		var srsTos []string
+		for _, to := range trx.RcptTos() {
+			if to.AsciiDomain() == config.SrsDomain.String() && looksLikeSrs(to.Local()) {
+				srsTos = append(srsTos, to.Addr)
+			}
+		}
+		// ValidateRcptTo normally already rejected these recipients, we only see them in dry-run mode
+		// or when the milter does not use ValidateRcptTo. Reject the whole message since silently removing
+		// recipients would lose mail without a DSN.
+		if len(srsTos) > 0 {
+			logger.Info("rejecting non-bounce to SRS address", "ofrom", trx.MailFrom().Addr, "to", strings.Join(srsTos, ","))
+			if dryRun {
+				return mailfilter.Accept, nil
+			}
+			return mailfilter.CustomErrorResponse(550, "5.7.1 SRS addresses only accept bounces"), nil
+		}
+	}
 
 	// change any rcpt to that is pointing to our SRS domain back to the real address
 	// (just in case that our socketmap server did not do that already)
@@ -29,85 +95,197 @@ func Filter(_ context.Context, trx mailfilter.Trx, config *Configuration, cache
 			continue
 		}
 		a := to.Addr
-		rewrittenTo, err := ReverseSrs(a, config)
+		rewrittenTo, keyIndex, err := reverseSrs(a, config)
 		if err != nil {
 			logger.Error("error while generating reverse SRS address", "oto", a, "to", rewrittenTo, "err", err)
 		} else {
 			logger.Debug("reverse SRS", "oto", a, "to", rewrittenTo)
+			if config.BounceMode && isBounce {
+				domain := addr.NewRcptTo(rewrittenTo, "", "").AsciiDomain()
+				count := cache.CountBounce(domain)
+				logger.Debug("bounce", "ofrom", trx.MailFrom().Addr, "to", rewrittenTo, "count", count, "window", bounceStatsWindow)
+			}
 			trx.AddRcptTo(rewrittenTo, "")
 			trx.DelRcptTo(a)
+			metricReverseRewrites.WithLabelValues("envelope", dryRunLabel).Inc()
 			actions = append(actions, fmt.Sprintf("recipient_env:%s:%s", a, rewrittenTo))
+			audit(AuditRecord{QueueId: trx.QueueId(), Action: AuditRecipientEnv, From: trx.MailFrom().Addr, To: []string{a}, NewTo: []string{rewrittenTo}, KeyIndex: keyIndex})
 		}
 	}
 
 	// Change the return path when it's not already one of my SRS and the mail goes to another MTA
 	// … but only when there is an SPF record for the return path that prevents me from sending without SRS
+	skipRule := -1
 	if !fromIsSrs && trx.MailFrom().Addr != "" {
+		if skipRule = config.SkipRewrite(trx); skipRule >= 0 {
+			logger.Debug("skipping SRS because of skipRewriteRules", "ofrom", trx.MailFrom().Addr, "rule", skipRule, "daemon", trx.MTA().Daemon, "addr", trx.Connect().Addr)
+		}
+	}
+	if !fromIsSrs && trx.MailFrom().Addr != "" && skipRule < 0 {
 		for _, to := range trx.RcptTos() {
+			isRemote := false
 			for _, t := range config.ResolveForward(to) {
-				if t.Addr != "" && !config.IsLocalDomain(t.AsciiDomain()) {
-					hasRemoteTo = true
+				if t.Addr == "" || config.IsLocalDomain(t.AsciiDomain()) {
+					logger.Debug("to is not remote", "to", t.Addr, "transport", t.Transport())
+					continue
+				}
+				switch config.RecipientPolicy(t.AsciiDomain()) {
+				case PolicyNever:
+					logger.Debug("to is remote but policy is never", "to", t.Addr, "transport", t.Transport())
+				case PolicyAlways:
+					isRemote = true
+					forceRewrite = true
+					logger.Debug("to is remote and policy is always", "to", t.Addr, "transport", t.Transport())
+				default:
+					isRemote = true
 					logger.Debug("to is remote", "to", t.Addr, "transport", t.Transport())
-					break
 				}
-				logger.Debug("to is not remote", "to", t.Addr, "transport", t.Transport())
+			}
+			if isRemote {
+				hasRemoteTo = true
+				remoteTos = append(remoteTos, to.Addr)
+			} else {
+				hasLocalTo = true
 			}
 		}
-		if hasRemoteTo && cache.IsLocalNotAllowedToSend(trx.MailFrom().Addr, trx.MailFrom().AsciiDomain()) {
+		rewrite := false
+		if hasRemoteTo {
+			switch {
+			case config.NeverRewriteSender(trx.MailFrom().Local(), trx.MailFrom().AsciiDomain()):
+				logger.Debug("sender is listed in neverRewriteSenders", "ofrom", trx.MailFrom().Addr)
+			case forceRewrite:
+				logger.Debug("recipient domain policy forces SRS", "ofrom", trx.MailFrom().Addr)
+				rewrite, reason = true, ReasonRecipientPolicy
+			case config.AlwaysRewriteSender(trx.MailFrom().Local(), trx.MailFrom().AsciiDomain()):
+				logger.Debug("sender is listed in alwaysRewriteSenders", "ofrom", trx.MailFrom().Addr)
+				rewrite, reason = true, ReasonSenderPolicy
+			default:
+				result := cache.SpfResult(trx.MailFrom().Addr, trx.MailFrom().AsciiDomain())
+				rewrite, reason, spfResult = isNotAllowedToSend(result), ReasonSpf, string(result)
+			}
+		}
+		if rewrite {
 			a := trx.MailFrom().Addr
 			srsAddress, err := ForwardSrs(a, config)
 			if err != nil {
 				logger.Error("error while generating SRS address", "ofrom", a, "from", srsAddress, "err", err)
+			} else if hasLocalTo && config.splitEnabled() && trx.Body() != nil {
+				// we split the message after we are done with all header modifications
+				logger.Debug("SRS for remote recipients only", "ofrom", a, "from", srsAddress, "remote", strings.Join(remoteTos, ","))
+				splitFrom = srsAddress
 			} else {
-				logger.Debug("SRS", "ofrom", a, "from", srsAddress)
+				logger.Debug("SRS", "ofrom", a, "from", srsAddress, "reason", reason)
 				// Sendmail does not like getting ESMTP args, so we always send empty ESMTP args
 				trx.ChangeMailFrom(srsAddress, "")
 				actions = append(actions, fmt.Sprintf("sender:%s:%s", a, srsAddress))
+				metricForwardRewrites.WithLabelValues(reason, dryRunLabel).Inc()
+				audit(AuditRecord{QueueId: trx.QueueId(), Action: AuditSender, From: a, NewFrom: srsAddress, To: rcptAddrs(trx), Reason: reason, SpfResult: spfResult})
+				if addTrace {
+					insertHeader(trx, config.TraceHeader, traceHeaderValue(a, reason))
+				}
 			}
 		}
 	}
 
-	// fix up To:, Cc: and Bcc: headers -- but only if there are no DKIM-Signatures that we might break
-	// (we assume that the To header is secured by the DKIM signature – almost all DKIM signers do this)
-	if !hasDkim {
-		fields := trx.Headers().Fields()
-		for fields.Next() {
-			switch fields.CanonicalKey() {
-			case "To", "Cc", "Bcc":
-			default:
+	// fix up the ReverseHeaders (To:, Cc: and Bcc: by default) -- but only if there are no DKIM-Signatures that we might break
+	// (we look at the h= tag of all signatures and assume that a signature we cannot parse covers all headers)
+	fields := trx.Headers().Fields()
+	for fields.Next() {
+		if !config.ReverseHeader(fields.CanonicalKey()) || fields.IsDeleted() {
+			continue
+		}
+		if dkim.Covers(fields.CanonicalKey()) {
+			logger.Debug("did not touch MIME header because of DKIM", "key", fields.Key())
+			continue
+		}
+		addresses, err := fields.AddressList()
+		if err != nil {
+			logger.Warn("error parsing address list, skipping", "key", fields.Key(), "value", fields.Value(), "err", err)
+			continue
+		}
+		changed := false
+		for _, a := range addresses {
+			to := addr.NewRcptTo(a.Address, "", "")
+			if to.AsciiDomain() != config.SrsDomain.String() || !looksLikeSrs(to.Local()) {
+				logger.Debug("to is not one of our SRS addresses", "to", to.Addr, "hdr", fields.Key())
 				continue
 			}
-			addresses, err := fields.AddressList()
+			rewrittenTo, keyIndex, err := reverseSrs(to.Addr, config)
 			if err != nil {
-				logger.Warn("error parsing address list, skipping", "key", fields.Key(), "value", fields.Value(), "err", err)
-				continue
-			}
-			changed := false
-			for _, a := range addresses {
-				to := addr.NewRcptTo(a.Address, "", "")
-				if to.AsciiDomain() != config.SrsDomain.String() || !looksLikeSrs(to.Local()) {
-					logger.Debug("to is not one of our SRS addresses", "to", to.Addr, "hdr", fields.Key())
-					continue
-				}
-				rewrittenTo, err := ReverseSrs(to.Addr, config)
-				if err != nil {
-					logger.Error("error while generating header reverse SRS address", "oto", to.Addr, "to", rewrittenTo, "err", err)
-				} else {
-					logger.Debug("header reverse SRS", "oto", to.Addr, "to", rewrittenTo)
-					a.Address = rewrittenTo
-					changed = true
-					actions = append(actions, fmt.Sprintf("recipient_hdr:%s:%s", to.Addr, rewrittenTo))
-				}
+				logger.Error("error while generating header reverse SRS address", "oto", to.Addr, "to", rewrittenTo, "err", err)
+			} else {
+				logger.Debug("header reverse SRS", "oto", to.Addr, "to", rewrittenTo)
+				a.Address = rewrittenTo
+				changed = true
+				metricReverseRewrites.WithLabelValues("header", dryRunLabel).Inc()
+				actions = append(actions, fmt.Sprintf("recipient_hdr:%s:%s", to.Addr, rewrittenTo))
+				audit(AuditRecord{QueueId: trx.QueueId(), Action: AuditRecipientHdr, From: trx.MailFrom().Addr, To: []string{to.Addr}, NewTo: []string{rewrittenTo}, Header: fields.CanonicalKey(), KeyIndex: keyIndex})
 			}
-			if changed {
-				fields.SetAddressList(addresses)
-				logger.Debug("fixing MIME header", "key", fields.Key(), "ovalue", fields.Value(), "addresses", outputAddresses(addresses))
+		}
+		if changed && !dryRun {
+			if len(addresses) == 1 && addresses[0].Name == "" && !strings.ContainsRune(fields.Value(), '<') && isASCII(addresses[0].Address) {
+				// keep bare addresses (e.g. in Delivered-To:) bare, but let the address formatter quote the local part
+				fields.Set(" " + strings.TrimSuffix(strings.TrimPrefix(addresses[0].String(), "<"), ">"))
 			} else {
-				logger.Debug("nothing to do", "key", fields.Key(), "value", fields.Value(), "addresses", outputAddresses(addresses))
+				fields.SetAddressList(addresses)
+			}
+			logger.Debug("fixing MIME header", "key", fields.Key(), "ovalue", fields.Value(), "addresses", outputAddresses(addresses))
+		} else if changed {
+			logger.Debug("would fix MIME header", "key", fields.Key(), "value", fields.Value(), "addresses", outputAddresses(addresses))
+		} else {
+			logger.Debug("nothing to do", "key", fields.Key(), "value", fields.Value(), "addresses", outputAddresses(addresses))
+		}
+	}
+
+	// fix up the delivery status and returned header of bounces -- but only if there are no DKIM-Signatures that we might break
+	if config.ReverseDsn && trx.Body() != nil && trx.MailFrom().Addr == "" {
+		if dkim.Signed() {
+			logger.Debug("did not touch DSN because of DKIM")
+		} else if _, err := trx.Body().Seek(0, io.SeekStart); err != nil {
+			logger.Warn("error reading body", "err", err)
+		} else if body, rewrites, err := config.reverseDsn(trx.Headers().Value("Content-Type"), trx.Body()); err != nil {
+			logger.Warn("error parsing DSN, skipping", "err", err)
+		} else if len(rewrites) > 0 {
+			logger.Debug("DSN reverse SRS", "rewrites", rewrites)
+			trx.ReplaceBody(bytes.NewReader(body))
+			for _, r := range rewrites {
+				actions = append(actions, "recipient_dsn:"+r.String())
+				audit(AuditRecord{QueueId: trx.QueueId(), Action: AuditRecipientDsn, From: trx.MailFrom().Addr, To: []string{r.From}, NewTo: []string{r.To}, KeyIndex: r.KeyIndex})
 			}
+			metricReverseRewrites.WithLabelValues("dsn", dryRunLabel).Add(float64(len(rewrites)))
+		}
+	}
+
+	// send a copy of the message with the SRS address to the remote recipients and remove them from this message,
+	// so that the local recipients get the message with the original sender
+	if splitFrom != "" {
+		a := trx.MailFrom().Addr
+		data := trx.Data()
+		if addTrace {
+			// only the copy for the remote recipients gets the trace header
+			data = io.MultiReader(strings.NewReader(fmt.Sprintf("%s: %s\r\n", config.TraceHeader, traceHeaderValue(a, reason))), data)
+		}
+		var err error
+		if !dryRun {
+			err = config.reinject(trx.MTA().FQDN, splitFrom, remoteTos, data)
+		}
+		if err != nil {
+			logger.Error("error while splitting message, rewriting sender for all recipients", "ofrom", a, "from", splitFrom, "err", err)
+			trx.ChangeMailFrom(splitFrom, "")
+			actions = append(actions, fmt.Sprintf("sender:%s:%s", a, splitFrom))
+			metricForwardRewrites.WithLabelValues(reason, dryRunLabel).Inc()
+			audit(AuditRecord{QueueId: trx.QueueId(), Action: AuditSender, From: a, NewFrom: splitFrom, To: rcptAddrs(trx), Reason: reason, SpfResult: spfResult})
+			if addTrace {
+				insertHeader(trx, config.TraceHeader, traceHeaderValue(a, reason))
+			}
+		} else {
+			for _, to := range remoteTos {
+				trx.DelRcptTo(to)
+			}
+			actions = append(actions, fmt.Sprintf("split:%s:%s:%s", a, splitFrom, strings.Join(remoteTos, "|")))
+			metricForwardRewrites.WithLabelValues(reason, dryRunLabel).Inc()
+			audit(AuditRecord{QueueId: trx.QueueId(), Action: AuditSplit, From: a, NewFrom: splitFrom, To: remoteTos, Reason: reason, SpfResult: spfResult})
 		}
-	} else {
-		logger.Debug("did not touch MIME headers because of DKIM")
 	}
 
 	if len(actions) > 0 {
@@ -119,6 +297,47 @@ func Filter(_ context.Context, trx mailfilter.Trx, config *Configuration, cache
 	return mailfilter.Accept, nil
 }
 
+// Reasons why Filter rewrote the envelope sender
+const (
+	ReasonSpf             = "spf"              // the SPF record of the sender does not allow us to send
+	ReasonRecipientPolicy = "recipient-policy" // a recipient domain has the policy "always"
+	ReasonSenderPolicy    = "sender-policy"    // the sender is listed in alwaysRewriteSenders
+)
+
+// traceHeaderValue is the value of the trace header we add when we rewrite the envelope sender from
+func traceHeaderValue(from, reason string) string {
+	return fmt.Sprintf("<%s> (rewritten by srs-milter; reason=%s)", from, reason)
+}
+
+// insertHeader adds the header field key at the top of the header (like a Received header)
+func insertHeader(trx mailfilter.Trx, key, value string) {
+	fields := trx.Headers().Fields()
+	if fields.Next() {
+		fields.InsertBefore(key, value)
+	} else {
+		trx.Headers().Add(key, value)
+	}
+}
+
+// rcptAddrs returns the addresses of the current envelope recipients of trx
+func rcptAddrs(trx mailfilter.Trx) []string {
+	var addrs []string
+	for _, to := range trx.RcptTos() {
+		addrs = append(addrs, to.Addr)
+	}
+	return addrs
+}
+
+// isASCII returns true when s only contains ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 func outputAddresses(addrs []*mail.Address) string {
 	b := strings.Builder{}
 	for i, a := range addrs {
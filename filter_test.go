@@ -2,8 +2,8 @@ package srsmilter
 
 import (
 	"context"
-	"net"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/d--j/go-milter/mailfilter"
@@ -14,15 +14,45 @@ import (
 
 func TestFilter(t *testing.T) {
 	t.Cleanup(monkeyPatch().Reset)
-	conf := &Configuration{
-		SrsDomain:    "srs.example.com",
-		LocalDomains: []Domain{ToDomain("example.com")},
-		SrsKeys:      []string{"secret-key"},
-		LocalIps:     []net.IP{net.ParseIP("8.8.8.8")},
-		LogLevel:     3,
-	}
-	conf.Setup()
+	conf := testConfig(t, &Configuration{
+		LogLevel: 3,
+	})
 	cache := NewCache(conf)
+	exemptConf := testConfig(t, &Configuration{
+		NeverRewriteSenders:  []string{"example.net"},
+		AlwaysRewriteSenders: []string{"forced@example.org", "never@example.net"},
+	})
+	exemptCache := NewCache(exemptConf)
+	policyConf := testConfig(t, &Configuration{
+		RecipientDomainPolicies: []RecipientDomainPolicy{
+			{Domains: []Domain{"relay.example.net"}, Policy: PolicyNever},
+			{Domains: []Domain{"gmail.example", "*.outlook.example"}, Policy: PolicyAlways},
+		},
+	})
+	policyCache := NewCache(policyConf)
+	skipConf := testConfig(t, &Configuration{
+		SkipRewriteRules: []SkipRewriteRule{
+			{Daemons: []string{"submission"}, Authenticated: true},
+			{ConnectAddrs: []string{"10.0.0.0/8", "192.0.2.1"}},
+		},
+	})
+	skipCache := NewCache(skipConf)
+	traceConf := testConfig(t, &Configuration{
+		AlwaysRewriteSenders:  []string{"forced@example.org"},
+		TraceHeader:           "X-SRS-Original-Sender",
+		TraceHeaderUnlessDkim: true,
+		StripHeaders:          []string{"x-srs-original-sender"},
+		TrustedNetworks:       []string{"198.51.100.0/24"},
+	})
+	traceCache := NewCache(traceConf)
+	headerConf := testConfig(t, &Configuration{
+		ReverseHeaders: []string{"to", "Reply-To", "resent-to", "Delivered-To", "X-Original-To"},
+	})
+	headerCache := NewCache(headerConf)
+	bounceConf := testConfig(t, &Configuration{
+		BounceMode: true,
+	})
+	bounceCache := NewCache(bounceConf)
 	newTrx := func() *testtrx.Trx {
 		return (&testtrx.Trx{}).
 			SetMTA(mailfilter.MTA{
@@ -82,6 +112,131 @@ func TestFilter(t *testing.T) {
 				SetRcptTosList("someone@example.net"),
 			conf, cache,
 		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS1=TWks=example.net==ABCD=46=example.org=not-local-srs1@srs.example.com"}}, false},
+		{"forward-never-rewrite", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("never@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net"),
+			exemptConf, exemptCache,
+		}, mailfilter.Accept, nil, false},
+		{"forward-always-rewrite", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("forced@example.org", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net"),
+			exemptConf, exemptCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=FjBL=46=example.org=forced@srs.example.com"}}, false},
+		{"forward-always-rewrite-local", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("forced@example.org", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.com"),
+			exemptConf, exemptCache,
+		}, mailfilter.Accept, nil, false},
+		{"forward-policy-never", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@relay.example.net"),
+			policyConf, policyCache,
+		}, mailfilter.Accept, nil, false},
+		{"forward-policy-never-mixed", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@relay.example.net", "someone@example.net"),
+			policyConf, policyCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}, false},
+		{"forward-policy-always", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local-no-spf@example.org", "", "smtp", "", "")).
+				SetRcptTosList("someone@mx.outlook.example"),
+			policyConf, policyCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=L9qF=46=example.org=not-local-no-spf@srs.example.com"}}, false},
+		{"forward-policy-spf", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local-no-spf@example.org", "", "smtp", "", "")).
+				SetRcptTosList("someone@outlook.example"),
+			policyConf, policyCache,
+		}, mailfilter.Accept, nil, false},
+		{"forward-skip-submission", args{
+			newTrx().
+				SetMTA(mailfilter.MTA{Version: "Postfix 2.3.0", FQDN: "mx.example.com", Daemon: "submission"}).
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "user", "PLAIN")).
+				SetRcptTosList("someone@example.net"),
+			skipConf, skipCache,
+		}, mailfilter.Accept, nil, false},
+		{"forward-skip-submission-not-authenticated", args{
+			newTrx().
+				SetMTA(mailfilter.MTA{Version: "Postfix 2.3.0", FQDN: "mx.example.com", Daemon: "submission"}).
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net"),
+			skipConf, skipCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}, false},
+		{"forward-skip-smtpd-authenticated", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "user", "PLAIN")).
+				SetRcptTosList("someone@example.net"),
+			skipConf, skipCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}, false},
+		{"forward-skip-connect-addr", args{
+			newTrx().
+				SetConnect(mailfilter.Connect{Host: "relay", Family: "tcp4", Port: 25, Addr: "10.1.2.3"}).
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net"),
+			skipConf, skipCache,
+		}, mailfilter.Accept, nil, false},
+		{"forward-trace", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net"),
+			traceConf, traceCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"},
+			{Kind: testtrx.InsertHeader, Index: 1, Name: "X-SRS-Original-Sender", Value: " <not-local@example.net> (rewritten by srs-milter; reason=spf)"},
+		}, false},
+		{"forward-trace-sender-policy", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("forced@example.org", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net"),
+			traceConf, traceCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.ChangeFrom, Addr: "SRS0=FjBL=46=example.org=forced@srs.example.com"},
+			{Kind: testtrx.InsertHeader, Index: 1, Name: "X-SRS-Original-Sender", Value: " <forced@example.org> (rewritten by srs-milter; reason=sender-policy)"},
+		}, false},
+		{"forward-trace-dkim", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net").
+				SetHeadersRaw([]byte("DKIM-Signature: bogus\r\nSubject: test\r\n\r\n")),
+			traceConf, traceCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}, false},
+		{"strip-untrusted", args{
+			newTrx().
+				SetConnect(mailfilter.Connect{Host: "remote", Family: "tcp4", Port: 25, Addr: "192.0.2.5"}).
+				SetHeadersRaw([]byte("Subject: test\r\nX-SRS-Original-Sender: <forged@example.com>\r\n\r\n")),
+			traceConf, traceCache,
+		}, mailfilter.Accept, []testtrx.Modification{{Kind: testtrx.ChangeHeader, Index: 1, Name: "X-SRS-Original-Sender", Value: ""}}, false},
+		{"strip-untrusted-and-add", args{
+			newTrx().
+				SetConnect(mailfilter.Connect{Host: "remote", Family: "tcp4", Port: 25, Addr: "192.0.2.5"}).
+				SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+				SetRcptTosList("someone@example.net").
+				SetHeadersRaw([]byte("Subject: test\r\nX-SRS-Original-Sender: <forged@example.com>\r\n\r\n")),
+			traceConf, traceCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"},
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "X-SRS-Original-Sender", Value: ""},
+			{Kind: testtrx.InsertHeader, Index: 1, Name: "X-SRS-Original-Sender", Value: " <not-local@example.net> (rewritten by srs-milter; reason=spf)"},
+		}, false},
+		{"strip-trusted-network", args{
+			newTrx().
+				SetConnect(mailfilter.Connect{Host: "relay", Family: "tcp4", Port: 25, Addr: "198.51.100.7"}).
+				SetHeadersRaw([]byte("Subject: test\r\nX-SRS-Original-Sender: <trusted@example.com>\r\n\r\n")),
+			traceConf, traceCache,
+		}, mailfilter.Accept, nil, false},
+		{"strip-authenticated", args{
+			newTrx().
+				SetConnect(mailfilter.Connect{Host: "remote", Family: "tcp4", Port: 25, Addr: "192.0.2.5"}).
+				SetMailFrom(addr.NewMailFrom("somebody@example.com", "", "smtp", "user", "PLAIN")).
+				SetHeadersRaw([]byte("Subject: test\r\nX-SRS-Original-Sender: <trusted@example.com>\r\n\r\n")),
+			traceConf, traceCache,
+		}, mailfilter.Accept, nil, false},
 		{"forward-bogus-email", args{
 			newTrx().
 				SetMailFrom(addr.NewMailFrom("(not-local@example.net", "", "smtp", "", "")).
@@ -122,6 +277,25 @@ func TestFilter(t *testing.T) {
 			{Kind: testtrx.DelRcptTo, Addr: "SRS0=PNjA=46=example.net=my-srs@srs.example.com"},
 			{Kind: testtrx.AddRcptTo, Addr: "my-srs@example.net"},
 		}, false},
+		{"reverse-my-srs-dkim-to-not-signed", args{
+			newTrx().
+				SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com").
+				SetHeadersRaw([]byte("DKIM-Signature: v=1; a=rsa-sha256; d=example.net; s=sel; h=from:subject:cc; bh=abc; b=abc\nFrom: Someone <someone@example.net>\nTo: Someone <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nCc: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nSubject: Test\n\n")),
+			conf, cache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.DelRcptTo, Addr: "SRS0=PNjA=46=example.net=my-srs@srs.example.com"},
+			{Kind: testtrx.AddRcptTo, Addr: "my-srs@example.net"},
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "To", Value: " \"Someone\" <my-srs@example.net>"},
+		}, false},
+		{"reverse-my-srs-dkim-to-signed", args{
+			newTrx().
+				SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com").
+				SetHeadersRaw([]byte("DKIM-Signature: v=1; a=rsa-sha256; d=example.net; s=sel; h=from:subject; bh=abc; b=abc\nDKIM-Signature: v=1; a=rsa-sha256; d=example.org; s=sel; h=From:To; bh=abc; b=abc\nFrom: Someone <someone@example.net>\nTo: Someone <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nSubject: Test\n\n")),
+			conf, cache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.DelRcptTo, Addr: "SRS0=PNjA=46=example.net=my-srs@srs.example.com"},
+			{Kind: testtrx.AddRcptTo, Addr: "my-srs@example.net"},
+		}, false},
 		{"reverse-my-srs-err", args{
 			newTrx().
 				SetRcptTosList("SRS0=XXXX=46=example.net=my-srs@srs.example.com").
@@ -147,6 +321,67 @@ func TestFilter(t *testing.T) {
 			{Kind: testtrx.AddRcptTo, Addr: "my-srs@example.net"},
 			{Kind: testtrx.ChangeHeader, Index: 1, Name: "To", Value: " \"Someone\" <my-srs@example.net>"},
 		}, false},
+		{"reverse-my-srs-extra-headers-default", args{
+			newTrx().
+				SetRcptTosList("local@example.com").
+				SetHeadersRaw([]byte("Delivered-To: SRS0=PNjA=46=example.net=my-srs@srs.example.com\nFrom: Someone <someone@example.net>\nTo: Someone <local@example.com>\nSubject: Test\n\n")),
+			conf, cache,
+		}, mailfilter.Accept, nil, false},
+		{"reverse-my-srs-extra-headers", args{
+			newTrx().
+				SetRcptTosList("local@example.com").
+				SetHeadersRaw([]byte("Delivered-To: SRS0=PNjA=46=example.net=my-srs@srs.example.com\nX-Original-To: SRS0=PNjA=46=example.net=my-srs@srs.example.com\nFrom: Someone <someone@example.net>\nTo: Someone <local@example.com>\nCc: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nReply-To: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nResent-To: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nSubject: Test\n\n")),
+			headerConf, headerCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "Resent-To", Value: " <my-srs@example.net>"},
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "Reply-To", Value: " <my-srs@example.net>"},
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "X-Original-To", Value: " my-srs@example.net"},
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "Delivered-To", Value: " my-srs@example.net"},
+		}, false},
+		{"reverse-my-srs-extra-headers-dkim", args{
+			newTrx().
+				SetRcptTosList("local@example.com").
+				SetHeadersRaw([]byte("DKIM-Signature: v=1; a=rsa-sha256; d=example.net; s=sel; h=from:subject:reply-to; bh=abc; b=abc\nDelivered-To: SRS0=PNjA=46=example.net=my-srs@srs.example.com\nFrom: Someone <someone@example.net>\nReply-To: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\nSubject: Test\n\n")),
+			headerConf, headerCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "Delivered-To", Value: " my-srs@example.net"},
+		}, false},
+		{"bounce-mode-null-sender", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("", "", "smtp", "", "")).
+				SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com"),
+			bounceConf, bounceCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.DelRcptTo, Addr: "SRS0=PNjA=46=example.net=my-srs@srs.example.com"},
+			{Kind: testtrx.AddRcptTo, Addr: "my-srs@example.net"},
+		}, false},
+		{"bounce-mode-postmaster", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("postmaster@example.org", "", "smtp", "", "")).
+				SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com"),
+			bounceConf, bounceCache,
+		}, mailfilter.Accept, []testtrx.Modification{
+			{Kind: testtrx.DelRcptTo, Addr: "SRS0=PNjA=46=example.net=my-srs@srs.example.com"},
+			{Kind: testtrx.AddRcptTo, Addr: "my-srs@example.net"},
+		}, false},
+		{"bounce-mode-reject", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("spammer@example.org", "", "smtp", "", "")).
+				SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com"),
+			bounceConf, bounceCache,
+		}, mailfilter.CustomErrorResponse(550, "5.7.1 SRS addresses only accept bounces"), nil, false},
+		{"bounce-mode-reject-mixed-rcpts", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("spammer@example.org", "", "smtp", "", "")).
+				SetRcptTosList("SRS0=PNjA=46=example.net=my-srs@srs.example.com", "local@example.com"),
+			bounceConf, bounceCache,
+		}, mailfilter.CustomErrorResponse(550, "5.7.1 SRS addresses only accept bounces"), nil, false},
+		{"bounce-mode-other-rcpt", args{
+			newTrx().
+				SetMailFrom(addr.NewMailFrom("someone@example.org", "", "smtp", "", "")).
+				SetRcptTosList("postmaster@srs.example.com"),
+			bounceConf, bounceCache,
+		}, mailfilter.Accept, nil, false},
 		{"reverse-other-srs", args{
 			newTrx().
 				SetRcptTosList("SRS0=R9Ph=46=example.net=other-srs@srs.example.net").
@@ -194,3 +429,232 @@ func Test_outputAddresses(t *testing.T) {
 		})
 	}
 }
+
+func TestFilter_reverseBareHeader(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	conf := testConfig(t, &Configuration{
+		ReverseHeaders: []string{"Delivered-To"},
+	})
+	tests := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{"ascii", "my-srs@example.net", " my-srs@example.net"},
+		{"utf-8", "jösé@example.net", " <jösé@example.net>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srs, err := ForwardSrs(tt.addr, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trx := (&testtrx.Trx{}).
+				SetMailFrom(addr.NewMailFrom("someone@example.net", "", "smtp", "", "")).
+				SetRcptTosList("local@example.com").
+				SetHeadersRaw([]byte("Delivered-To: " + srs + "\nSubject: Test\n\n"))
+			if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+				t.Fatal(err)
+			}
+			want := []testtrx.Modification{{Kind: testtrx.ChangeHeader, Index: 1, Name: "Delivered-To", Value: tt.want}}
+			if got := trx.Modifications(); !reflect.DeepEqual(got, want) {
+				t.Errorf("trx.Modifications() got = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFilter_split(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	newConf := func(relay string) *Configuration {
+		return testConfig(t, &Configuration{
+			SplitMixedRecipients: true,
+			SplitRelayAddr:       relay,
+		})
+	}
+	newTrx := func(tos ...string) *testtrx.Trx {
+		return (&testtrx.Trx{}).
+			SetMTA(mailfilter.MTA{FQDN: "mx.example.com"}).
+			SetConnect(mailfilter.Connect{Family: "tcp4", Addr: "192.0.2.1"}).
+			SetMailFrom(addr.NewMailFrom("not-local@example.net", "", "smtp", "", "")).
+			SetRcptTosList(tos...).
+			SetHeadersRaw([]byte("Subject: test\r\n\r\n")).
+			SetBodyBytes([]byte("body\r\n"))
+	}
+
+	t.Run("split", func(t *testing.T) {
+		relay, session := fakeSmtpServer(t, "")
+		conf := newConf(relay)
+		trx := newTrx("local@example.com", "someone@example.net")
+		if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+			t.Fatal(err)
+		}
+		want := []testtrx.Modification{{Kind: testtrx.DelRcptTo, Addr: "someone@example.net"}}
+		if !reflect.DeepEqual(trx.Modifications(), want) {
+			t.Errorf("trx.Modifications() got = %v, want %v", trx.Modifications(), want)
+		}
+		got := strings.Join(<-session, "\n")
+		wantSession := "EHLO mx.example.com\nMAIL FROM:<SRS0=+5us=46=example.net=not-local@srs.example.com>\nRCPT TO:<someone@example.net>\nDATA\nSubject: test\n\nbody\n.\nQUIT"
+		if got != wantSession {
+			t.Errorf("relay session = %q, want %q", got, wantSession)
+		}
+	})
+	t.Run("split-trace", func(t *testing.T) {
+		relay, session := fakeSmtpServer(t, "")
+		conf := newConf(relay)
+		conf.TraceHeader = "X-SRS-Original-Sender"
+		trx := newTrx("local@example.com", "someone@example.net")
+		if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+			t.Fatal(err)
+		}
+		want := []testtrx.Modification{{Kind: testtrx.DelRcptTo, Addr: "someone@example.net"}}
+		if !reflect.DeepEqual(trx.Modifications(), want) {
+			t.Errorf("trx.Modifications() got = %v, want %v", trx.Modifications(), want)
+		}
+		got := strings.Join(<-session, "\n")
+		wantSession := "EHLO mx.example.com\nMAIL FROM:<SRS0=+5us=46=example.net=not-local@srs.example.com>\nRCPT TO:<someone@example.net>\nDATA\nX-SRS-Original-Sender: <not-local@example.net> (rewritten by srs-milter; reason=spf)\nSubject: test\n\nbody\n.\nQUIT"
+		if got != wantSession {
+			t.Errorf("relay session = %q, want %q", got, wantSession)
+		}
+	})
+	t.Run("only-remote", func(t *testing.T) {
+		conf := newConf("127.0.0.1:1")
+		trx := newTrx("someone@example.net")
+		if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+			t.Fatal(err)
+		}
+		want := []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}
+		if !reflect.DeepEqual(trx.Modifications(), want) {
+			t.Errorf("trx.Modifications() got = %v, want %v", trx.Modifications(), want)
+		}
+	})
+	t.Run("relay-error", func(t *testing.T) {
+		relay, _ := fakeSmtpServer(t, "someone@example.net")
+		conf := newConf(relay)
+		trx := newTrx("local@example.com", "someone@example.net")
+		if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+			t.Fatal(err)
+		}
+		want := []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}
+		if !reflect.DeepEqual(trx.Modifications(), want) {
+			t.Errorf("trx.Modifications() got = %v, want %v", trx.Modifications(), want)
+		}
+	})
+	// other features that need the body must not enable the split
+	disabledTests := []struct {
+		name  string
+		split bool
+		relay bool
+	}{
+		{"split-disabled", false, true},
+		{"no-relay", true, false},
+	}
+	for _, tt := range disabledTests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay, _ := fakeSmtpServer(t, "")
+			conf := newConf(relay)
+			conf.VerifyDkim = true
+			conf.ReverseDsn = true
+			conf.SplitMixedRecipients = tt.split
+			if !tt.relay {
+				conf.SplitRelayAddr = ""
+			}
+			trx := newTrx("local@example.com", "someone@example.net")
+			if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+				t.Fatal(err)
+			}
+			want := []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}
+			if !reflect.DeepEqual(trx.Modifications(), want) {
+				t.Errorf("trx.Modifications() got = %v, want %v", trx.Modifications(), want)
+			}
+		})
+	}
+	t.Run("no-body", func(t *testing.T) {
+		conf := newConf("127.0.0.1:1")
+		trx := newTrx("local@example.com", "someone@example.net").SetBody(nil)
+		if _, err := Filter(context.Background(), trx, conf, NewCache(conf)); err != nil {
+			t.Fatal(err)
+		}
+		want := []testtrx.Modification{{Kind: testtrx.ChangeFrom, Addr: "SRS0=+5us=46=example.net=not-local@srs.example.com"}}
+		if !reflect.DeepEqual(trx.Modifications(), want) {
+			t.Errorf("trx.Modifications() got = %v, want %v", trx.Modifications(), want)
+		}
+	})
+}
+
+func TestFilter_verifyDkim(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	conf := testConfig(t, &Configuration{
+		VerifyDkim:    true,
+		DkimLookupTXT: dkimTestLookupTXT,
+	})
+	message := "From: Someone <someone@example.net>\r\nTo: <SRS0=PNjA=46=example.net=my-srs@srs.example.com>\r\nSubject: Test\r\n\r\nbody\r\n"
+	newTrx := func(message string) *testtrx.Trx {
+		headers, body, _ := strings.Cut(message, "\r\n\r\n")
+		return (&testtrx.Trx{}).
+			SetMailFrom(addr.NewMailFrom("someone@example.net", "", "smtp", "", "")).
+			SetRcptTosList("local@example.com").
+			SetHeadersRaw([]byte(headers + "\r\n\r\n")).
+			SetBodyBytes([]byte(body))
+	}
+	tests := []struct {
+		name              string
+		trx               *testtrx.Trx
+		wantModifications []testtrx.Modification
+	}{
+		{"valid", newTrx(dkimSign(t, message, "sel", "From", "To")), nil},
+		{"invalid", newTrx(dkimSign(t, message, "unknown", "From", "To")), []testtrx.Modification{
+			{Kind: testtrx.ChangeHeader, Index: 1, Name: "To", Value: " <my-srs@example.net>"},
+		}},
+		{"no-body", newTrx(dkimSign(t, message, "unknown", "From", "To")).SetBody(nil), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Filter(context.Background(), tt.trx, conf, NewCache(conf)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.trx.Modifications(), tt.wantModifications) {
+				t.Errorf("trx.Modifications() got = %v, want %v", tt.trx.Modifications(), tt.wantModifications)
+			}
+		})
+	}
+}
+
+func TestFilter_reverseDsn(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	conf := testConfig(t, &Configuration{
+		ReverseDsn: true,
+	})
+	body := testDsn("Final-Recipient: rfc822; SRS0=PNjA=46=example.net=my-srs@srs.example.com\n", "Content-Type: text/rfc822-headers\n\nSubject: test\n")
+	newTrx := func(from, headers string) *testtrx.Trx {
+		return (&testtrx.Trx{}).
+			SetMailFrom(addr.NewMailFrom(from, "", "smtp", "", "")).
+			SetRcptTosList("local@example.com").
+			SetHeadersRaw([]byte("Content-Type: " + testDsnContentType + "\r\n" + headers + "\r\n")).
+			SetBodyBytes([]byte(body))
+	}
+	tests := []struct {
+		name     string
+		trx      *testtrx.Trx
+		wantBody string
+	}{
+		{"bounce", newTrx("", ""), strings.Replace(body, "SRS0=PNjA=46=example.net=my-srs@srs.example.com\r\n", "my-srs@example.net\r\n", 1)},
+		{"not-a-bounce", newTrx("someone@example.com", ""), ""},
+		{"dkim", newTrx("", "DKIM-Signature: v=1; a=rsa-sha256; d=example.net; s=sel; h=from:subject; bh=abc; b=abc\r\n"), ""},
+		{"no-body", newTrx("", "").SetBody(nil), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Filter(context.Background(), tt.trx, conf, NewCache(conf)); err != nil {
+				t.Fatal(err)
+			}
+			var want []testtrx.Modification
+			if tt.wantBody != "" {
+				want = []testtrx.Modification{{Kind: testtrx.ReplaceBody, Body: []byte(tt.wantBody)}}
+			}
+			if !reflect.DeepEqual(tt.trx.Modifications(), want) {
+				t.Errorf("trx.Modifications() got = %v, want %v", tt.trx.Modifications(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package srsmilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"blitiri.com.ar/go/spf"
+)
+
+// CheckDb returns an error when we use a database and it is not reachable
+func (c *Configuration) CheckDb(ctx context.Context) error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.PingContext(ctx)
+}
+
+// CheckSpf does a canary SPF lookup for HealthSpfDomain (or SrsDomain when it is not set) and returns an error
+// when the lookup failed because of a DNS error. It does not use or change the cached results.
+func (c *Cache) CheckSpf(ctx context.Context) error {
+	domain := c.conf.HealthSpfDomain.String()
+	if domain == "" {
+		domain = c.conf.SrsDomain.String()
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	if len(c.conf.LocalIps) > 0 {
+		ip = c.conf.LocalIps[0]
+	}
+	result, err := spf.CheckHostWithSender(ip, domain, "postmaster@"+domain, spf.WithContext(ctx))
+	if result == spf.TempError {
+		return fmt.Errorf("SPF lookup for %s failed: %w", domain, err)
+	}
+	return nil
+}
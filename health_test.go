@@ -0,0 +1,78 @@
+package srsmilter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/agiledragon/gomonkey/v2"
+)
+
+func TestConfiguration_CheckDb(t *testing.T) {
+	tests := []struct {
+		name    string
+		useDb   bool
+		closeDb bool
+		wantErr bool
+	}{
+		{"no-db", false, false, false},
+		{"ok", true, false, false},
+		{"closed", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Configuration{SrsDomain: "srs.example.com"}
+			if tt.useDb {
+				c.DbDriver = "srsmilter-fake"
+				c.DbDSN = newFakeDb(t, nil)
+				c.DbForwardQuery = "forward"
+			}
+			if err := c.Setup(); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = c.Close() })
+			if tt.closeDb {
+				_ = c.db.Close()
+			}
+			if err := c.CheckDb(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("CheckDb() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCache_CheckSpf(t *testing.T) {
+	var domains []string
+	patches := gomonkey.ApplyFunc(spf.CheckHostWithSender, func(_ net.IP, helo, _ string, _ ...spf.Option) (spf.Result, error) {
+		domains = append(domains, helo)
+		if helo == "broken.example" {
+			return spf.TempError, errors.New("timeout")
+		}
+		return spf.None, nil
+	})
+	t.Cleanup(patches.Reset)
+	tests := []struct {
+		name       string
+		domain     Domain
+		wantDomain string
+		wantErr    bool
+	}{
+		{"srs-domain", "", "srs.example.com", false},
+		{"canary", "canary.example", "canary.example", false},
+		{"temp-error", "broken.example", "broken.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domains = nil
+			c := NewCache(&Configuration{SrsDomain: "srs.example.com", HealthSpfDomain: tt.domain})
+			if err := c.CheckSpf(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSpf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(domains) != 1 || domains[0] != tt.wantDomain {
+				t.Errorf("CheckSpf() looked up %v, want %v", domains, tt.wantDomain)
+			}
+		})
+	}
+}
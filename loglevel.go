@@ -0,0 +1,104 @@
+package srsmilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+)
+
+// LogLevel is the verbosity of our logging. It uses the same numbering as log15.Lvl.
+type LogLevel uint
+
+const (
+	LogLevelCrit LogLevel = iota
+	LogLevelError
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// logSubsystems are the values of the "sub" log context that can have their own log level
+var logSubsystems = []string{"milter", "socketmap", "spf", "forward", "domains"}
+
+var logLevelNames = map[string]LogLevel{
+	"crit":    LogLevelCrit,
+	"error":   LogLevelError,
+	"warn":    LogLevelWarn,
+	"warning": LogLevelWarn,
+	"info":    LogLevelInfo,
+	"debug":   LogLevelDebug,
+}
+
+// ParseLogLevel parses the name (crit, error, warn, info or debug) or number (0-4) of a log level
+func ParseLogLevel(s string) (LogLevel, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if l, ok := logLevelNames[s]; ok {
+		return l, nil
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return LogLevel(n), nil
+	}
+	return 0, fmt.Errorf("invalid log level %q (use crit, error, warn, info or debug)", s)
+}
+
+// Lvl returns the log15.Lvl of l. All levels above LogLevelDebug are LogLevelDebug.
+func (l LogLevel) Lvl() log15.Lvl {
+	if l > LogLevelDebug {
+		return log15.LvlDebug
+	}
+	return log15.Lvl(l)
+}
+
+func (l LogLevel) String() string {
+	switch l.Lvl() {
+	case log15.LvlCrit:
+		return "crit"
+	case log15.LvlError:
+		return "error"
+	case log15.LvlWarn:
+		return "warn"
+	case log15.LvlInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+// validateLogLevels makes sure that LogLevels only contains known subsystems
+func validateLogLevels(levels map[string]LogLevel) error {
+outer:
+	for sub := range levels {
+		for _, known := range logSubsystems {
+			if sub == known {
+				continue outer
+			}
+		}
+		return fmt.Errorf("unknown subsystem %q in logLevels (use %s)", sub, strings.Join(logSubsystems, ", "))
+	}
+	return nil
+}
+
+// LogLevelFor returns the log level of the subsystem sub. Subsystems without their own log level use LogLevel.
+func (c *Configuration) LogLevelFor(sub string) LogLevel {
+	if l, ok := c.LogLevels[sub]; ok {
+		return l
+	}
+	return c.LogLevel
+}
+
+// LogFilterHandler returns a handler that only passes records to h whose level is enabled
+// for the subsystem in their "sub" context value
+func LogFilterHandler(c *Configuration, h log15.Handler) log15.Handler {
+	return log15.FilterHandler(func(r *log15.Record) bool {
+		sub := ""
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			if r.Ctx[i] == "sub" {
+				sub, _ = r.Ctx[i+1].(string)
+				break
+			}
+		}
+		return r.Lvl <= c.LogLevelFor(sub).Lvl()
+	}, h)
+}
@@ -0,0 +1,88 @@
+package srsmilter
+
+import (
+	"testing"
+
+	"github.com/inconshreveable/log15"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LogLevel
+		wantErr bool
+	}{
+		{"crit", LogLevelCrit, false},
+		{"error", LogLevelError, false},
+		{"warn", LogLevelWarn, false},
+		{"warning", LogLevelWarn, false},
+		{" INFO ", LogLevelInfo, false},
+		{"debug", LogLevelDebug, false},
+		{"0", LogLevelCrit, false},
+		{"3", LogLevelInfo, false},
+		{"9", 9, false},
+		{"verbose", 0, true},
+		{"-1", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLogLevel(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLogLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogLevel_Lvl(t *testing.T) {
+	if got := LogLevelWarn.Lvl(); got != log15.LvlWarn {
+		t.Errorf("Lvl() = %v, want %v", got, log15.LvlWarn)
+	}
+	if got := LogLevel(9).Lvl(); got != log15.LvlDebug {
+		t.Errorf("Lvl() = %v, want %v", got, log15.LvlDebug)
+	}
+	if got := LogLevel(9).String(); got != "debug" {
+		t.Errorf("String() = %v, want debug", got)
+	}
+}
+
+func TestConfiguration_Setup_logLevels(t *testing.T) {
+	c := &Configuration{SrsDomain: "srs.example.com", LogLevels: map[string]LogLevel{"milters": LogLevelDebug}}
+	if err := c.Setup(); err == nil {
+		t.Errorf("Setup() expected error for unknown subsystem")
+	}
+}
+
+func TestLogFilterHandler(t *testing.T) {
+	c := &Configuration{LogLevel: LogLevelWarn, LogLevels: map[string]LogLevel{"socketmap": LogLevelDebug, "milter": LogLevelCrit}}
+	tests := []struct {
+		name string
+		lvl  log15.Lvl
+		ctx  []interface{}
+		want bool
+	}{
+		{"global-warn", log15.LvlWarn, nil, true},
+		{"global-info", log15.LvlInfo, nil, false},
+		{"socketmap-debug", log15.LvlDebug, []interface{}{"sub", "socketmap", "key", "a@example.com"}, true},
+		{"milter-error", log15.LvlError, []interface{}{"sub", "milter"}, false},
+		{"milter-crit", log15.LvlCrit, []interface{}{"sub", "milter"}, true},
+		{"spf-falls-back", log15.LvlWarn, []interface{}{"domain", "example.com", "sub", "spf"}, true},
+		{"spf-falls-back-info", log15.LvlInfo, []interface{}{"sub", "spf"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := false
+			h := LogFilterHandler(c, log15.FuncHandler(func(r *log15.Record) error {
+				got = true
+				return nil
+			}))
+			_ = h.Log(&log15.Record{Lvl: tt.lvl, Msg: "test", Ctx: tt.ctx})
+			if got != tt.want {
+				t.Errorf("LogFilterHandler() passed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
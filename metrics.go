@@ -0,0 +1,88 @@
+package srsmilter
+
+import (
+	"errors"
+
+	"github.com/mileusna/srs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics is the registry of all our Prometheus metrics
+var Metrics = prometheus.NewRegistry()
+
+const metricsNamespace = "srs_milter"
+
+var (
+	metricMessages = promauto.With(Metrics).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_processed_total",
+		Help:      "Number of messages the milter processed.",
+	})
+	metricForwardRewrites = promauto.With(Metrics).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forward_rewrites_total",
+		Help:      "Number of envelope senders that got SRS rewritten, by reason and whether it was a dry run.",
+	}, []string{"reason", "dry_run"})
+	metricReverseRewrites = promauto.With(Metrics).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reverse_rewrites_total",
+		Help:      "Number of SRS addresses that got reverse rewritten by the milter, by kind (envelope, header or dsn) and whether it was a dry run.",
+	}, []string{"kind", "dry_run"})
+	metricDecodeFailures = promauto.With(Metrics).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decode_failures_total",
+		Help:      "Number of SRS addresses we could not decode, by reason.",
+	}, []string{"reason"})
+	metricSocketmapLookups = promauto.With(Metrics).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "socketmap_lookups_total",
+		Help:      "Number of socketmap lookups, by map name and result.",
+	}, []string{"map", "result"})
+	metricSpfCache = promauto.With(Metrics).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spf_cache_requests_total",
+		Help:      "Number of SPF cache requests, by result (hit or miss).",
+	}, []string{"result"})
+	metricSpfCacheEvictions = promauto.With(Metrics).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spf_cache_evictions_total",
+		Help:      "Number of entries that got evicted from the SPF cache.",
+	})
+	metricSpfLookupDuration = promauto.With(Metrics).NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "spf_lookup_duration_seconds",
+		Help:      "Duration of SPF lookups.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricForwardQueryDuration = promauto.With(Metrics).NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "forward_query_duration_seconds",
+		Help:      "Duration of forward database queries.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricForwardQueryErrors = promauto.With(Metrics).NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forward_query_errors_total",
+		Help:      "Number of forward database queries that failed.",
+	})
+)
+
+// Socketmap lookup results
+const (
+	socketmapFound    = "found"
+	socketmapNotFound = "not_found"
+	socketmapError    = "error"
+)
+
+// decodeFailureReason maps the error of ReverseSrs to the reason label of decode_failures_total
+func decodeFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrNoValidKey), errors.Is(err, srs.ErrHashInvalid), errors.Is(err, srs.ErrHashTooShort):
+		return "hash"
+	case errors.Is(err, srs.ErrTimestampWrongSlot), errors.Is(err, srs.ErrTimestampInvalidBase32):
+		return "timestamp"
+	default:
+		return "malformed"
+	}
+}
@@ -0,0 +1,50 @@
+package srsmilter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mileusna/srs"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_decodeFailureReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrNoValidKey, "hash"},
+		{srs.ErrHashInvalid, "hash"},
+		{srs.ErrHashTooShort, "hash"},
+		{srs.ErrTimestampWrongSlot, "timestamp"},
+		{srs.ErrTimestampInvalidBase32, "timestamp"},
+		{srs.ErrNoSRS, "malformed"},
+		{errors.New("other"), "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := decodeFailureReason(tt.err); got != tt.want {
+				t.Errorf("decodeFailureReason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics_Socketmap(t *testing.T) {
+	t.Cleanup(monkeyPatch().Reset)
+	conf := testConfig(t, &Configuration{})
+	found := testutil.ToFloat64(metricSocketmapLookups.WithLabelValues("decode", socketmapFound))
+	failed := testutil.ToFloat64(metricSocketmapLookups.WithLabelValues("decode", socketmapError))
+	hash := testutil.ToFloat64(metricDecodeFailures.WithLabelValues("hash"))
+	_, _, _ = Socketmap(conf, "decode", "SRS0=PNjA=46=example.net=my-srs@srs.example.com")
+	_, _, _ = Socketmap(conf, "decode", "SRS0=XXXX=46=example.net=my-srs@srs.example.com")
+	if got := testutil.ToFloat64(metricSocketmapLookups.WithLabelValues("decode", socketmapFound)) - found; got != 1 {
+		t.Errorf("found lookups = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metricSocketmapLookups.WithLabelValues("decode", socketmapError)) - failed; got != 1 {
+		t.Errorf("failed lookups = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metricDecodeFailures.WithLabelValues("hash")) - hash; got != 1 {
+		t.Errorf("hash decode failures = %v, want 1", got)
+	}
+}
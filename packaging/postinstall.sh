@@ -70,7 +70,9 @@ cleanInstall() {
   chmod 0640 /etc/srs-milter/srs-milter.yml || :
   seedConfig
   fixSystemdUnit
-  if [ "${use_systemctl}" = "False" ]; then
+  if [ "${use_systemctl}" = "False" ] && command -V rc-update >/dev/null 2>&1; then
+    printf "\033[32m Enable the service with: rc-update add srs-milter default\033[0m\n"
+  elif [ "${use_systemctl}" = "False" ]; then
     printf "\033[31m srs-milter does not support your init system. You need to setup daemon starting on your own.\033[0m\n"
   else
     printf "\033[32m Reload the service unit from disk\033[0m\n"
@@ -0,0 +1,278 @@
+package srsmilter
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/d--j/go-milter/mailfilter"
+)
+
+// RewritePolicy decides whether mail to a remote recipient domain gets SRS rewritten
+type RewritePolicy string
+
+const (
+	// PolicySpf rewrites when the SPF record of the sender does not allow us to send (the default)
+	PolicySpf RewritePolicy = "spf"
+	// PolicyAlways always rewrites the sender
+	PolicyAlways RewritePolicy = "always"
+	// PolicyNever never rewrites the sender – the recipient domain gets treated like a local domain
+	PolicyNever RewritePolicy = "never"
+)
+
+// RecipientDomainPolicy is the Policy for mail that gets forwarded to any of Domains
+type RecipientDomainPolicy struct {
+	Domains []Domain
+	Policy  RewritePolicy
+}
+
+type recipientDomainPolicy struct {
+	domains *domainMatcher
+	policy  RewritePolicy
+}
+
+func newRecipientDomainPolicies(in []RecipientDomainPolicy) ([]recipientDomainPolicy, error) {
+	policies := make([]recipientDomainPolicy, 0, len(in))
+	for _, p := range in {
+		switch p.Policy {
+		case PolicySpf, PolicyAlways, PolicyNever:
+		default:
+			return nil, fmt.Errorf("invalid recipient domain policy %q", p.Policy)
+		}
+		m := newDomainMatcher(false)
+		for _, d := range p.Domains {
+			if err := m.Add(d); err != nil {
+				return nil, err
+			}
+		}
+		policies = append(policies, recipientDomainPolicy{domains: m, policy: p.Policy})
+	}
+	return policies, nil
+}
+
+// addressMatcher matches email addresses against a list of addresses and domain patterns.
+// Entries without local part (or with the local part "*") are matched with a domainMatcher.
+type addressMatcher struct {
+	addresses map[string]bool
+	domains   *domainMatcher
+}
+
+func newAddressMatcher(entries []string) (*addressMatcher, error) {
+	m := &addressMatcher{
+		addresses: make(map[string]bool),
+		domains:   newDomainMatcher(false),
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		local, domain := "", entry
+		if !isDomainRegexp(entry) {
+			if at := strings.LastIndexByte(entry, '@'); at >= 0 {
+				local, domain = entry[:at], entry[at+1:]
+			}
+		}
+		d, err := ParseDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		if local == "" || local == "*" {
+			if err = m.domains.Add(d); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		m.addresses[strings.ToLower(local)+"@"+d.String()] = true
+	}
+	return m, nil
+}
+
+// Match returns true when the address local@asciiDomain matches any of the entries of m
+func (m *addressMatcher) Match(local, asciiDomain string) bool {
+	if m == nil {
+		return false
+	}
+	if m.addresses[strings.ToLower(local)+"@"+strings.ToLower(asciiDomain)] {
+		return true
+	}
+	return m.domains.Match(strings.ToLower(asciiDomain))
+}
+
+// NeverRewriteSender returns true when the sender local@asciiDomain is listed in NeverRewriteSenders
+func (c *Configuration) NeverRewriteSender(local, asciiDomain string) bool {
+	return c.neverRewriteSenders.Match(local, asciiDomain)
+}
+
+// AlwaysRewriteSender returns true when the sender local@asciiDomain is listed in AlwaysRewriteSenders
+func (c *Configuration) AlwaysRewriteSender(local, asciiDomain string) bool {
+	return c.alwaysRewriteSenders.Match(local, asciiDomain)
+}
+
+// RecipientPolicy returns the RewritePolicy of the first RecipientDomainPolicies entry that matches asciiDomain.
+// It returns PolicySpf when no entry matches.
+func (c *Configuration) RecipientPolicy(asciiDomain string) RewritePolicy {
+	for _, p := range c.recipientDomainPolicies {
+		if p.domains.Match(asciiDomain) {
+			return p.policy
+		}
+	}
+	return PolicySpf
+}
+
+// SkipRewriteRule describes transactions whose sender never gets SRS rewritten.
+// All conditions that are set need to match. Setup rejects rules without any conditions.
+type SkipRewriteRule struct {
+	// Authenticated matches when the sender authenticated with SMTP AUTH
+	Authenticated bool
+	// AuthUsers matches when the sender authenticated as any of these users
+	AuthUsers []string
+	// LocalSender matches when the sender address is in one of the local domains
+	LocalSender bool
+	// Daemons matches when the MTA daemon name ({daemon_name} macro, e.g. the Postfix service name) is in this list
+	Daemons []string
+	// ConnectAddrs matches when the client IP address is in this list of IP addresses and CIDR networks
+	ConnectAddrs []string
+}
+
+type skipRewriteRule struct {
+	rule     SkipRewriteRule
+	networks []*net.IPNet
+}
+
+func newSkipRewriteRules(in []SkipRewriteRule) ([]skipRewriteRule, error) {
+	rules := make([]skipRewriteRule, 0, len(in))
+	for _, r := range in {
+		if !r.Authenticated && len(r.AuthUsers) == 0 && !r.LocalSender && len(r.Daemons) == 0 && len(r.ConnectAddrs) == 0 {
+			return nil, fmt.Errorf("skip rewrite rule %d has no conditions", len(rules))
+		}
+		rule := skipRewriteRule{rule: r}
+		for _, a := range r.ConnectAddrs {
+			network, err := parseNetwork(a)
+			if err != nil {
+				return nil, err
+			}
+			rule.networks = append(rule.networks, network)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseNetwork parses a CIDR network or a single IP address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.IndexByte(s, '/') >= 0 {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (r *skipRewriteRule) matches(c *Configuration, trx mailfilter.Trx) bool {
+	from := trx.MailFrom()
+	if r.rule.Authenticated && from.AuthenticatedUser() == "" {
+		return false
+	}
+	if len(r.rule.AuthUsers) > 0 && !containsFold(r.rule.AuthUsers, from.AuthenticatedUser()) {
+		return false
+	}
+	if r.rule.LocalSender && !c.IsLocalDomain(from.AsciiDomain()) {
+		return false
+	}
+	if len(r.rule.Daemons) > 0 && !containsFold(r.rule.Daemons, trx.MTA().Daemon) {
+		return false
+	}
+	if len(r.networks) > 0 {
+		ip := net.ParseIP(trx.Connect().Addr)
+		if ip == nil {
+			return false
+		}
+		found := false
+		for _, n := range r.networks {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SkipRewrite returns the index of the first SkipRewriteRules entry that matches trx.
+// It returns -1 when no rule matches.
+func (c *Configuration) SkipRewrite(trx mailfilter.Trx) int {
+	for i := range c.skipRewriteRules {
+		if c.skipRewriteRules[i].matches(c, trx) {
+			return i
+		}
+	}
+	return -1
+}
+
+// defaultReverseHeaders are the header fields we reverse SRS when ReverseHeaders is not set
+var defaultReverseHeaders = []string{"To", "Cc", "Bcc"}
+
+// newHeaderKeys returns a set of the canonical keys of the header field names in
+func newHeaderKeys(in []string) map[string]bool {
+	keys := make(map[string]bool, len(in))
+	for _, k := range in {
+		if k = strings.TrimSpace(k); k != "" {
+			keys[textproto.CanonicalMIMEHeaderKey(k)] = true
+		}
+	}
+	return keys
+}
+
+// ReverseHeader returns true when we should reverse SRS the addresses in the header field with the canonical key canonicalKey
+func (c *Configuration) ReverseHeader(canonicalKey string) bool {
+	return c.reverseHeaders[canonicalKey]
+}
+
+// IsTrustedConnection returns true when trx comes from an authenticated user, from a loopback address,
+// from one of LocalIps or TrustedNetworks or via a non-TCP connection (e.g. Postfix' non_smtpd_milters).
+func (c *Configuration) IsTrustedConnection(trx mailfilter.Trx) bool {
+	if trx.MailFrom().AuthenticatedUser() != "" {
+		return true
+	}
+	ip := net.ParseIP(trx.Connect().Addr)
+	if ip == nil {
+		return trx.Connect().Family != "tcp4" && trx.Connect().Family != "tcp6"
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, l := range c.LocalIps {
+		if l.Equal(ip) {
+			return true
+		}
+	}
+	for _, n := range c.trustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
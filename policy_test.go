@@ -0,0 +1,165 @@
+package srsmilter
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_addressMatcher_Match(t *testing.T) {
+	m, err := newAddressMatcher([]string{"User@Example.com", "example.net", "*@example.org", "@*.example.biz", "/^list[0-9]+\\.example$/", "  ", "ünicode@näkkileipä.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		local       string
+		asciiDomain string
+		want        bool
+	}{
+		{"address", "user", "example.com", true},
+		{"address-case", "USER", "EXAMPLE.COM", true},
+		{"other-address", "other", "example.com", false},
+		{"domain", "someone", "example.net", true},
+		{"domain-sub", "someone", "sub.example.net", false},
+		{"star-domain", "someone", "example.org", true},
+		{"wildcard", "someone", "sub.example.biz", true},
+		{"wildcard-itself", "someone", "example.biz", false},
+		{"regexp", "someone", "list1.example", true},
+		{"idna", "ünicode", "xn--nkkileip-0zah.example", true},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Match(tt.local, tt.asciiDomain); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newAddressMatcher(t *testing.T) {
+	if _, err := newAddressMatcher([]string{"/(broken/"}); err == nil {
+		t.Errorf("newAddressMatcher() expected error for broken regexp")
+	}
+	if _, err := newAddressMatcher([]string{"user@bogus*domain"}); err == nil {
+		t.Errorf("newAddressMatcher() expected error for broken domain")
+	}
+	var m *addressMatcher
+	if m.Match("user", "example.com") {
+		t.Errorf("nil matcher matched")
+	}
+}
+
+func TestConfiguration_RecipientPolicy(t *testing.T) {
+	c := Configuration{RecipientDomainPolicies: []RecipientDomainPolicy{
+		{Domains: toDomainSlice([]string{"relay.example.com"}), Policy: PolicyNever},
+		{Domains: toDomainSlice([]string{"gmail.com", "*.outlook.com"}), Policy: PolicyAlways},
+		{Domains: toDomainSlice([]string{"*.example.com"}), Policy: PolicySpf},
+		{Domains: toDomainSlice([]string{"sub.example.com"}), Policy: PolicyNever},
+	}}
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		asciiDomain string
+		want        RewritePolicy
+	}{
+		{"relay.example.com", PolicyNever},
+		{"gmail.com", PolicyAlways},
+		{"eu.outlook.com", PolicyAlways},
+		{"outlook.com", PolicySpf},
+		{"sub.example.com", PolicySpf},
+		{"example.org", PolicySpf},
+	}
+	for _, tt := range tests {
+		t.Run(tt.asciiDomain, func(t *testing.T) {
+			if got := c.RecipientPolicy(tt.asciiDomain); got != tt.want {
+				t.Errorf("RecipientPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRecipientDomainPolicies(t *testing.T) {
+	if _, err := newRecipientDomainPolicies([]RecipientDomainPolicy{{Domains: toDomainSlice([]string{"example.com"}), Policy: "sometimes"}}); err == nil {
+		t.Errorf("newRecipientDomainPolicies() expected error for invalid policy")
+	}
+	if _, err := newRecipientDomainPolicies([]RecipientDomainPolicy{{Domains: []Domain{"/(broken/"}, Policy: PolicyNever}}); err == nil {
+		t.Errorf("newRecipientDomainPolicies() expected error for broken regexp")
+	}
+}
+
+func Test_newSkipRewriteRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []SkipRewriteRule
+		wantErr bool
+	}{
+		{"empty", nil, false},
+		{"no-conditions", []SkipRewriteRule{{}}, true},
+		{"ip", []SkipRewriteRule{{ConnectAddrs: []string{"127.0.0.1", "::1"}}}, false},
+		{"cidr", []SkipRewriteRule{{ConnectAddrs: []string{"10.0.0.0/8", "2001:db8::/32"}}}, false},
+		{"broken-ip", []SkipRewriteRule{{ConnectAddrs: []string{"localhost"}}}, true},
+		{"broken-cidr", []SkipRewriteRule{{ConnectAddrs: []string{"10.0.0.0/33"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newSkipRewriteRules(tt.rules); (err != nil) != tt.wantErr {
+				t.Errorf("newSkipRewriteRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseNetwork(t *testing.T) {
+	tests := []struct {
+		in       string
+		contains string
+		want     bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.1", "127.0.0.2", false},
+		{"::1", "::1", true},
+		{"::ffff:127.0.0.1", "127.0.0.1", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in+"-"+tt.contains, func(t *testing.T) {
+			n, err := parseNetwork(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n.Contains(net.ParseIP(tt.contains)); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfiguration_ReverseHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		key     string
+		want    bool
+	}{
+		{"default-to", nil, "To", true},
+		{"default-bcc", nil, "Bcc", true},
+		{"default-delivered-to", nil, "Delivered-To", false},
+		{"custom", []string{"delivered-to", " Reply-To "}, "Delivered-To", true},
+		{"custom-reply-to", []string{"delivered-to", " Reply-To "}, "Reply-To", true},
+		{"custom-replaces-default", []string{"delivered-to"}, "To", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Configuration{SrsDomain: "srs.example.com", ReverseHeaders: tt.headers}
+			if err := c.Setup(); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.ReverseHeader(tt.key); got != tt.want {
+				t.Errorf("ReverseHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
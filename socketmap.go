@@ -4,18 +4,22 @@ func Socketmap(config *Configuration, lookup, key string) (result string, found
 	logger := Log.New("sub", "socketmap", "lookup", lookup, "key", key)
 	if lookup != "decode" {
 		logger.Debug("no decode request")
+		metricSocketmapLookups.WithLabelValues(lookup, socketmapNotFound).Inc()
 		return "", false, nil
 	}
 	local, domain := split(key)
 	if domain.String() != config.SrsDomain.String() || !looksLikeSrs(local) {
 		logger.Debug("not my SRS address")
+		metricSocketmapLookups.WithLabelValues(lookup, socketmapNotFound).Inc()
 		return "", false, nil
 	}
 	email, err := ReverseSrs(key, config)
 	if err != nil {
 		logger.Warn("error decoding", "err", err)
+		metricSocketmapLookups.WithLabelValues(lookup, socketmapError).Inc()
 		return "", false, nil
 	}
 	logger.Debug("decoded", "result", email)
+	metricSocketmapLookups.WithLabelValues(lookup, socketmapFound).Inc()
 	return email, true, nil
 }
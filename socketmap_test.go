@@ -1,20 +1,12 @@
 package srsmilter
 
-import (
-	"net"
-	"testing"
-)
+import "testing"
 
 func TestSocketmap(t *testing.T) {
 	t.Cleanup(monkeyPatch().Reset)
-	conf := &Configuration{
-		SrsDomain:    "srs.example.com",
-		LocalDomains: []Domain{ToDomain("example.com")},
-		SrsKeys:      []string{"secret-key"},
-		LocalIps:     []net.IP{net.ParseIP("8.8.8.8")},
-		LogLevel:     3,
-	}
-	conf.Setup()
+	conf := testConfig(t, &Configuration{
+		LogLevel: 3,
+	})
 	type args struct {
 		lookup string
 		key    string
@@ -0,0 +1,82 @@
+package srsmilter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// defaultSplitTimeout is used when SplitTimeout is not set
+const defaultSplitTimeout = 30 * time.Second
+
+// NeedsBody returns true when Filter needs the message body to do its work.
+// The milter then needs to make its decision at the end of the message.
+func (c *Configuration) NeedsBody() bool {
+	return c.splitEnabled() || c.VerifyDkim || c.ReverseDsn
+}
+
+// splitEnabled returns true when Filter should split messages with local and remote recipients
+func (c *Configuration) splitEnabled() bool {
+	return c.SplitMixedRecipients && c.SplitRelayAddr != ""
+}
+
+// reinject sends a copy of the message data with the envelope sender from to the recipients tos via SplitRelayAddr.
+// It gets used to split a message with local and remote recipients.
+// The copy is not transactional: it gets sent before the MTA accepted the original message.
+func (c *Configuration) reinject(helo, from string, tos []string, data io.Reader) error {
+	timeout := c.SplitTimeout
+	if timeout <= 0 {
+		timeout = defaultSplitTimeout
+	}
+	return sendMail(c.SplitRelayAddr, timeout, helo, from, tos, data)
+}
+
+// sendMail delivers data to addr via plain SMTP.
+// In contrast to [smtp.SendMail] it never uses STARTTLS since addr is a local relay that normally has no valid certificate.
+func sendMail(addr string, timeout time.Duration, helo, from string, tos []string, data io.Reader) (err error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if helo != "" {
+		if err = c.Hello(helo); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, to := range tos {
+		if err = c.Rcpt(to); err != nil {
+			return fmt.Errorf("RCPT TO %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
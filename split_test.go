@@ -0,0 +1,133 @@
+package srsmilter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSmtpServer accepts one SMTP session on a random local port and records the commands and the message data.
+// Every RCPT TO for an address in reject gets rejected.
+func fakeSmtpServer(t *testing.T, reject string) (addr string, session <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	ch := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = io.WriteString(conn, s+"\r\n") }
+		reply("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				ch <- lines
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch {
+			case inData && line == ".":
+				inData = false
+				reply("250 queued")
+			case inData:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "RCPT TO:") && reject != "" && strings.Contains(line, reject):
+				reply("550 rejected")
+			case line == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+				ch <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func Test_sendMail(t *testing.T) {
+	addr, session := fakeSmtpServer(t, "")
+	err := sendMail(addr, time.Second, "mx.example.com", "SRS0=x@srs.example.com", []string{"one@example.net", "two@example.org"}, strings.NewReader("Subject: test\r\n\r\n.body\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(<-session, "\n")
+	want := "EHLO mx.example.com\nMAIL FROM:<SRS0=x@srs.example.com>\nRCPT TO:<one@example.net>\nRCPT TO:<two@example.org>\nDATA\nSubject: test\n\n..body\n.\nQUIT"
+	if got != want {
+		t.Errorf("sendMail() session = %q, want %q", got, want)
+	}
+}
+
+func Test_sendMail_errors(t *testing.T) {
+	addr, _ := fakeSmtpServer(t, "two@example.org")
+	err := sendMail(addr, time.Second, "mx.example.com", "SRS0=x@srs.example.com", []string{"one@example.net", "two@example.org"}, strings.NewReader("Subject: test\r\n\r\nbody\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "two@example.org") {
+		t.Errorf("sendMail() error = %v, want rejected recipient", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+	if err := sendMail(closedAddr, time.Second, "", "a@example.com", []string{"b@example.com"}, strings.NewReader("")); err == nil {
+		t.Errorf("sendMail() expected error for closed port")
+	}
+	// a relay that accepts the connection but never sends its greeting
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = silent.Close() })
+	go func() {
+		conn, err := silent.Accept()
+		if err == nil {
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+	start := time.Now()
+	if err := sendMail(silent.Addr().String(), 100*time.Millisecond, "", "a@example.com", []string{"b@example.com"}, strings.NewReader("")); err == nil {
+		t.Errorf("sendMail() expected error for silent relay")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sendMail() took %v, want it to time out", d)
+	}
+}
+
+func TestConfiguration_NeedsBody(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *Configuration
+		want bool
+	}{
+		{"default", &Configuration{}, false},
+		{"no-relay", &Configuration{SplitMixedRecipients: true}, false},
+		{"split", &Configuration{SplitMixedRecipients: true, SplitRelayAddr: "127.0.0.1:10026"}, true},
+		{"verify-dkim", &Configuration{VerifyDkim: true}, true},
+		{"reverse-dsn", &Configuration{ReverseDsn: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.NeedsBody(); got != tt.want {
+				t.Errorf("NeedsBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -23,8 +23,17 @@ func ForwardSrs(addr string, config *Configuration) (string, error) {
 	return srsAddress, nil
 }
 
+// ErrNoValidKey is returned by ReverseSrs when none of the SrsKeys produced a valid hash
+var ErrNoValidKey = errors.New("no SRS key found or all tried keys failed")
+
 func ReverseSrs(srsAddress string, config *Configuration) (string, error) {
-	for _, key := range config.SrsKeys {
+	addr, _, err := reverseSrs(srsAddress, config)
+	return addr, err
+}
+
+// reverseSrs is ReverseSrs that also returns the index of the key in SrsKeys that validated srsAddress
+func reverseSrs(srsAddress string, config *Configuration) (string, int, error) {
+	for i, key := range config.SrsKeys {
 		s := srs.SRS{
 			Secret:         []byte(key),
 			Domain:         config.SrsDomain.String(),
@@ -32,13 +41,15 @@ func ReverseSrs(srsAddress string, config *Configuration) (string, error) {
 		}
 		addr, err := s.Reverse(srsAddress)
 		if err != nil && err != srs.ErrHashInvalid {
-			return "", err
+			metricDecodeFailures.WithLabelValues(decodeFailureReason(err)).Inc()
+			return "", -1, err
 		}
 		if err == nil {
-			return addr, nil
+			return addr, i, nil
 		}
 	}
-	return "", errors.New("no SRS key found or all tried keys failed")
+	metricDecodeFailures.WithLabelValues(decodeFailureReason(ErrNoValidKey)).Inc()
+	return "", -1, ErrNoValidKey
 }
 
 func looksLikeSrs(local string) bool {